@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"go.yaml.in/yaml/v4"
+)
+
+// Condition は規則を適用する条件。指定されたすべての項目を満たすときに適用する
+// 各項目はグロブのパターンの一覧で、いずれかに合致すれば満たす
+type Condition struct {
+	Hosts    []string
+	Users    []string
+	OSes     []string
+	Distros  []string
+	Profiles []string
+	Env      []EnvCondition
+}
+
+// EnvCondition は環境変数についての条件
+type EnvCondition struct {
+	Name VarName
+	// nil なら変数が設定されていないことを条件とする
+	Patterns []string
+}
+
+// Machine は条件の判定に使う実行環境の情報
+type Machine struct {
+	Host string
+	User string
+	// runtime.GOOS
+	OS string
+	// /etc/os-release の ID。Linux 以外では空
+	Distro string
+}
+
+// Check は条件を満たせば nil を、満たさなければ満たさない項目を説明するエラーを返す
+func (condition *Condition) Check(context MatchContext) error {
+	if !matchAnyPattern(condition.Hosts, context.Machine.Host) {
+		return fmt.Errorf("host '%s' does not match %v", context.Machine.Host, condition.Hosts)
+	}
+	if !matchAnyPattern(condition.Users, context.Machine.User) {
+		return fmt.Errorf("user '%s' does not match %v", context.Machine.User, condition.Users)
+	}
+	if !matchAnyPattern(condition.OSes, context.Machine.OS) {
+		return fmt.Errorf("os '%s' does not match %v", context.Machine.OS, condition.OSes)
+	}
+	if !matchAnyPattern(condition.Distros, context.Machine.Distro) {
+		return fmt.Errorf("distro '%s' does not match %v", context.Machine.Distro, condition.Distros)
+	}
+	if !matchAnyPattern(condition.Profiles, context.Profile) {
+		return fmt.Errorf("profile '%s' does not match %v", context.Profile, condition.Profiles)
+	}
+	for _, envCondition := range condition.Env {
+		value, ok := context.Environment[envCondition.Name]
+		if envCondition.Patterns == nil {
+			if ok {
+				return fmt.Errorf("env '%s' is set", envCondition.Name)
+			}
+			continue
+		}
+		if !ok {
+			return fmt.Errorf("env '%s' is not set", envCondition.Name)
+		}
+		if !matchAnyPattern(envCondition.Patterns, value) {
+			return fmt.Errorf("env '%s' does not match %v", envCondition.Name, envCondition.Patterns)
+		}
+	}
+	return nil
+}
+
+// conditionEnvNames は条件で参照する環境変数の名前を重複なしで順に返す
+func conditionEnvNames(varsConfig *VarsConfig) []string {
+	names := make([]string, 0)
+	for _, pathItems := range *varsConfig {
+		for _, pathItem := range pathItems {
+			if pathItem.Condition == nil {
+				continue
+			}
+			for _, env := range pathItem.Condition.Env {
+				names = append(names, env.Name)
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// matchAnyPattern はパターンが指定されていないか、いずれかに合致するかを判定する
+func matchAnyPattern(patterns []string, value string) bool {
+	if patterns == nil {
+		return true
+	}
+	for _, pattern := range patterns {
+		// パターンは unmarshalCondition で検証済み
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func unmarshalCondition(node *yaml.Node) (*Condition, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("condition must be a mapping, got kind: %v", node.Kind)
+	}
+	var condition Condition
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k := node.Content[i]
+		v := node.Content[i+1]
+		if k.Value == "env" {
+			env, err := unmarshalEnvConditions(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid env conditions, because %w", err)
+			}
+			condition.Env = env
+			continue
+		}
+		patterns, err := unmarshalPatterns(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid patterns for '%s', because %w", k.Value, err)
+		}
+		switch k.Value {
+		case "host":
+			condition.Hosts = patterns
+		case "user":
+			condition.Users = patterns
+		case "os":
+			condition.OSes = patterns
+		case "distro":
+			condition.Distros = patterns
+		case "profile":
+			condition.Profiles = patterns
+		default:
+			return nil, fmt.Errorf("unknown condition: '%s'", k.Value)
+		}
+	}
+	return &condition, nil
+}
+
+// unmarshalEnvConditions は 変数名 → パターン の対応を解析する。null は変数が設定されていないことを表す
+func unmarshalEnvConditions(node *yaml.Node) ([]EnvCondition, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("env conditions must be a mapping, got kind: %v", node.Kind)
+	}
+	env := make([]EnvCondition, 0, len(node.Content)/2)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k := node.Content[i]
+		v := node.Content[i+1]
+		if k.Kind != yaml.ScalarNode || !isValidVarName(k.Value) {
+			return nil, fmt.Errorf("invalid variable name: '%s'", k.Value)
+		}
+		envCondition := EnvCondition{Name: k.Value}
+		if v.Kind != yaml.ScalarNode || v.Tag != "!!null" {
+			patterns, err := unmarshalPatterns(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid patterns for '%s', because %w", k.Value, err)
+			}
+			envCondition.Patterns = patterns
+		}
+		env = append(env, envCondition)
+	}
+	return env, nil
+}
+
+// unmarshalPatterns はスカラーか配列で書かれたグロブのパターンを解析する
+func unmarshalPatterns(node *yaml.Node) ([]string, error) {
+	var nodes []*yaml.Node
+	switch node.Kind {
+	case yaml.ScalarNode:
+		nodes = []*yaml.Node{node}
+	case yaml.SequenceNode:
+		nodes = node.Content
+	default:
+		return nil, fmt.Errorf("patterns must be a scalar or array, got kind: %v", node.Kind)
+	}
+	patterns := make([]string, 0, len(nodes))
+	for _, patternNode := range nodes {
+		if patternNode.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("pattern must be a scalar, got kind: %v", patternNode.Kind)
+		}
+		if _, err := path.Match(patternNode.Value, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s', because %w", patternNode.Value, err)
+		}
+		patterns = append(patterns, patternNode.Value)
+	}
+	return patterns, nil
+}
+
+// readDistro は /etc/os-release から ID を読む。ファイルがなければ空文字列
+func readDistro() (string, error) {
+	file, err := os.Open("/etc/os-release")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to open /etc/os-release, because %w", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if id, ok := strings.CutPrefix(scanner.Text(), "ID="); ok {
+			return strings.Trim(id, `"'`), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read /etc/os-release, because %w", err)
+	}
+	return "", nil
+}
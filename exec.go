@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// execCachePrefix はコマンドの出力を使い回すためのファイル名の最初の部分
+const execCachePrefix = "exec."
+
+// ExecCacheEntry は使い回すコマンドの出力
+type ExecCacheEntry struct {
+	Value     string    `json:"value"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// makeExecCachePath は exec の ID、コマンドテンプレート、引数ごとのファイルのパスを返す
+// ファイル名から引数がわからないように鍵付きハッシュにする
+func makeExecCachePath(key []byte, execId ExecId, execConfig ExecConfig, args []string) string {
+	mac := hmac.New(sha256.New, key)
+	for _, s := range append([]string{execId, execConfig.Command}, args...) {
+		mac.Write([]byte(s))
+		mac.Write([]byte{0})
+	}
+	return filepath.Join(makeSessionDir(), execCachePrefix+hex.EncodeToString(mac.Sum(nil)))
+}
+
+// readExecCache は使い回せる出力がなければ nil を返す。壊れていたり別の鍵で暗号化されていたりすれば、ないものとみなす
+func readExecCache(key []byte, path string) (*ExecCacheEntry, error) {
+	plaintext, err := readSealedSessionFile(key, execCachePurpose, path)
+	if errors.Is(err, errCannotDecrypt) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read an exec cache file: %s, because %w", path, err)
+	}
+	if plaintext == nil {
+		return nil, nil
+	}
+	var entry ExecCacheEntry
+	if err := json.Unmarshal(plaintext, &entry); err != nil {
+		return nil, nil
+	}
+	return &entry, nil
+}
+
+func writeExecCache(key []byte, path string, entry *ExecCacheEntry) error {
+	plaintext, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal an exec cache, because %w", err)
+	}
+	if err := writeSealedSessionFile(key, execCachePurpose, path, plaintext); err != nil {
+		return fmt.Errorf("failed to write an exec cache file: %s, because %w", path, err)
+	}
+	return nil
+}
+
+// runCachedExecCommand は TTL が設定されていれば、期限内の前回の出力を使い回す
+func runCachedExecCommand(key []byte, execId ExecId, execConfig ExecConfig, args []string) (string, error) {
+	if execConfig.TTL == 0 {
+		return runExecCommand(execConfig.Command, args)
+	}
+	path := makeExecCachePath(key, execId, execConfig, args)
+	entry, err := readExecCache(key, path)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if entry != nil && now.Before(entry.ExpiresAt) {
+		return entry.Value, nil
+	}
+	value, err := runExecCommand(execConfig.Command, args)
+	if err != nil {
+		return "", err
+	}
+	if err := writeExecCache(key, path, &ExecCacheEntry{Value: value, ExpiresAt: now.Add(execConfig.TTL)}); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// isExecCacheExpired は期限切れか、読めなければ true を返す
+func isExecCacheExpired(key []byte, path string) (bool, error) {
+	entry, err := readExecCache(key, path)
+	if err != nil {
+		return false, err
+	}
+	return entry == nil || !time.Now().Before(entry.ExpiresAt), nil
+}
+
+// clearExecCache はコマンドの出力をすべて消し、すべてのシェルで次に評価し直させる
+func clearExecCache() error {
+	dir := makeSessionDir()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read the directory: %s, because %w", dir, err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), execCachePrefix) {
+			path := filepath.Join(dir, entry.Name())
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove the file: %s, because %w", path, err)
+			}
+			continue
+		}
+		if session, ok := parseSessionFileName(entry.Name()); ok && entry.Name() == filepath.Base(makeCachePath(session)) {
+			reloadSession(session)
+		}
+	}
+	return nil
+}
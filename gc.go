@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+var errProcessNotFound = errors.New("process not found")
+
+// gcInterval は通常の実行で gc する間隔
+const gcInterval = 24 * time.Hour
+
+// sessionFileKinds はシェルごとのファイル名の最初の部分。script は以前の版のキャッシュ
+var sessionFileKinds = []string{"cache", "profile", "snapshot", "lock", "shell", "script"}
+
+// ShellRecord はセッションのシェル。PID の再利用や、別の PID 名前空間のシェルを見分けるのに使う
+type ShellRecord struct {
+	Pid       uint   `json:"pid"`
+	Namespace string `json:"namespace"`
+	StartTime string `json:"startTime"`
+}
+
+func makeShellRecord(shellPid uint) (*ShellRecord, error) {
+	startTime, err := readProcessStartTime(shellPid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the start time of the process: %d, because %w", shellPid, err)
+	}
+	return &ShellRecord{Pid: shellPid, Namespace: readPidNamespace(), StartTime: startTime}, nil
+}
+
+// readShellRecord は記録がなければ nil を返す
+func readShellRecord(session SessionId) *ShellRecord {
+	recordPath := makeShellRecordPath(session)
+	bytes, err := readSessionFile(recordPath)
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to read a shell record file: %s, because %w", recordPath, err))
+	}
+	if bytes == nil {
+		return nil
+	}
+	var record ShellRecord
+	if err := json.Unmarshal(bytes, &record); err != nil {
+		log.Fatal(fmt.Errorf("failed to unmarshal a shell record file: %s, because %w", recordPath, err))
+	}
+	return &record
+}
+
+func writeShellRecord(session SessionId, record *ShellRecord) {
+	recordPath := makeShellRecordPath(session)
+	bytes, err := json.Marshal(record)
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to marshal a shell record, because %w", err))
+	}
+	if err := writeSessionFile(recordPath, bytes); err != nil {
+		log.Fatal(fmt.Errorf("failed to write a shell record file: %s, because %w", recordPath, err))
+	}
+}
+
+// parseSessionFileName はシェルごとのファイル名からセッションを取り出す
+// 書き込み途中の一時ファイルも対象にする
+func parseSessionFileName(name string) (SessionId, bool) {
+	parts := strings.Split(name, ".")
+	if len(parts) < 2 || !slices.Contains(sessionFileKinds, parts[0]) || !isValidSessionId(parts[1]) {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// isSessionAlive はセッションのシェルが生きていれば true を返す
+// PID が別のプロセスに再利用されていれば、記録した開始時刻と違うので false を返す
+func isSessionAlive(session SessionId) (bool, error) {
+	record := readShellRecord(session)
+	if record == nil {
+		shellPid, ok := parseSessionPid(session)
+		if !ok {
+			// 記録のないトークンのシェルは確かめようがないので残す
+			return true, nil
+		}
+		record = &ShellRecord{Pid: shellPid, Namespace: readPidNamespace()}
+	}
+	if record.Namespace != readPidNamespace() {
+		// 別の PID 名前空間のシェルは確かめようがないので残す
+		return true, nil
+	}
+	startTime, err := readProcessStartTime(record.Pid)
+	if err != nil {
+		if errors.Is(err, errProcessNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to read the start time of the process: %d, because %w", record.Pid, err)
+	}
+	return record.StartTime == "" || record.StartTime == startTime, nil
+}
+
+// collectGarbage は終了したシェルのファイルと、期限切れのコマンドの出力を消す
+func collectGarbage() error {
+	dirs := []string{makeSessionDir()}
+	if legacyDir := filepath.Dir(makeLegacyCachedScriptPath("0")); legacyDir != dirs[0] {
+		dirs = append(dirs, legacyDir)
+	}
+	key := readCacheKey()
+	alive := make(map[SessionId]bool)
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("failed to read the directory: %s, because %w", dir, err)
+		}
+		for _, entry := range entries {
+			if dir == dirs[0] && strings.HasPrefix(entry.Name(), execCachePrefix) {
+				// 書き込み途中の一時ファイルは書いているプロセスが片付ける
+				if strings.HasSuffix(entry.Name(), ".tmp") {
+					continue
+				}
+				path := filepath.Join(dir, entry.Name())
+				expired, err := isExecCacheExpired(key, path)
+				if err != nil {
+					return err
+				}
+				if expired {
+					if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+						return fmt.Errorf("failed to remove the file: %s, because %w", path, err)
+					}
+				}
+				continue
+			}
+			session, ok := parseSessionFileName(entry.Name())
+			if !ok {
+				continue
+			}
+			isAlive, ok := alive[session]
+			if !ok {
+				isAlive, err = isSessionAlive(session)
+				if err != nil {
+					return err
+				}
+				alive[session] = isAlive
+			}
+			if isAlive {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove the file: %s, because %w", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// collectGarbageOccasionally は前回から gcInterval 以上経っていれば gc する
+// シェルの実行を止めないように、失敗してもログに出すだけにする
+func collectGarbageOccasionally() {
+	path := filepath.Join(makeSessionDir(), "gc")
+	info, err := os.Stat(path)
+	if err == nil && time.Since(info.ModTime()) < gcInterval {
+		return
+	}
+	if err := writeSessionFile(path, nil); err != nil {
+		log.Print(fmt.Errorf("failed to record the time of gc, because %w", err))
+		return
+	}
+	if err := collectGarbage(); err != nil {
+		log.Print(fmt.Errorf("failed to collect garbage, because %w", err))
+	}
+}
+
+// resetSessionIfReused は PID で見分けるセッションの PID が別のシェルに再利用されていれば、前のシェルのファイルを消してシェルを記録し直す
+func resetSessionIfReused(session SessionId) {
+	shellPid, ok := parseSessionPid(session)
+	if !ok {
+		// トークンは再利用されない
+		return
+	}
+	record, err := makeShellRecord(shellPid)
+	if err != nil {
+		// PID 名前空間の外のシェルなどは確かめようがない
+		if errors.Is(err, errProcessNotFound) {
+			return
+		}
+		log.Fatal(err)
+	}
+	previousRecord := readShellRecord(session)
+	if previousRecord != nil && *previousRecord == *record {
+		return
+	}
+	if previousRecord != nil {
+		for _, path := range []string{makeCachePath(session), makeProfilePath(session), makeSnapshotPath(session)} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				log.Fatal(fmt.Errorf("failed to remove a file of the previous shell: %s, because %w", path, err))
+			}
+		}
+	}
+	writeShellRecord(session, record)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GitRepository は作業ディレクトリーを含む git のワークツリー
+type GitRepository struct {
+	Root string
+	// リモートの URL を host/path の形に正規化したもの
+	Remotes []string
+}
+
+// findGitRepository は directory から親へ .git を探す。見つからなければ nil
+func findGitRepository(directory string) (*GitRepository, error) {
+	for {
+		dotGit := filepath.Join(directory, ".git")
+		info, err := os.Stat(dotGit)
+		if err == nil {
+			gitDir := dotGit
+			if !info.IsDir() {
+				// ワークツリーやサブモジュールでは .git は gitdir を指すファイル
+				gitDir, err = readGitDirFile(dotGit)
+				if err != nil {
+					return nil, err
+				}
+			}
+			configPath := filepath.Join(findGitCommonDir(gitDir), "config")
+			urls, err := readGitRemoteURLs(configPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read git config: %s, because %w", configPath, err)
+			}
+			remotes := make([]string, 0, len(urls))
+			for _, url := range urls {
+				remotes = append(remotes, normalizeGitURL(url))
+			}
+			return &GitRepository{Root: directory, Remotes: remotes}, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to stat: %s, because %w", dotGit, err)
+		}
+		parent := filepath.Dir(directory)
+		if parent == directory {
+			return nil, nil
+		}
+		directory = parent
+	}
+}
+
+func readGitDirFile(path string) (string, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read: %s, because %w", path, err)
+	}
+	gitDir, ok := strings.CutPrefix(strings.TrimSpace(string(bytes)), "gitdir:")
+	if !ok {
+		return "", fmt.Errorf("invalid .git file: %s", path)
+	}
+	gitDir = strings.TrimSpace(gitDir)
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(filepath.Dir(path), gitDir)
+	}
+	return gitDir, nil
+}
+
+// findGitCommonDir はリンクされたワークツリーの場合に設定を共有している git ディレクトリーを返す
+func findGitCommonDir(gitDir string) string {
+	bytes, err := os.ReadFile(filepath.Join(gitDir, "commondir"))
+	if err != nil {
+		return gitDir
+	}
+	commonDir := strings.TrimSpace(string(bytes))
+	if !filepath.IsAbs(commonDir) {
+		commonDir = filepath.Join(gitDir, commonDir)
+	}
+	return commonDir
+}
+
+func readGitRemoteURLs(configPath string) ([]string, error) {
+	file, err := os.Open(configPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	return parseGitRemoteURLs(file)
+}
+
+// parseGitRemoteURLs は git の設定ファイルから [remote "..."] の url を集める
+func parseGitRemoteURLs(reader io.Reader) ([]string, error) {
+	urls := make([]string, 0)
+	inRemote := false
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid section header: %s", line)
+			}
+			name, _, _ := strings.Cut(strings.TrimSpace(line[1:end]), " ")
+			inRemote = strings.EqualFold(name, "remote")
+			continue
+		}
+		if !inRemote {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(key), "url") {
+			continue
+		}
+		urls = append(urls, strings.Trim(strings.TrimSpace(value), `"`))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+// normalizeGitURL は git@github.com:acme/repo.git や https://github.com/acme/repo を github.com/acme/repo にする
+func normalizeGitURL(url string) string {
+	if scheme, rest, ok := strings.Cut(url, "://"); ok && !strings.Contains(scheme, "/") {
+		url = rest
+		// ユーザー名とポートを取り除く
+		host, path, _ := strings.Cut(url, "/")
+		if i := strings.LastIndexByte(host, '@'); 0 <= i {
+			host = host[i+1:]
+		}
+		if i := strings.LastIndexByte(host, ':'); 0 <= i {
+			host = host[:i]
+		}
+		url = host + "/" + path
+	} else if host, path, ok := strings.Cut(url, ":"); ok && !strings.Contains(host, "/") {
+		// scp 風の user@host:path
+		if i := strings.LastIndexByte(host, '@'); 0 <= i {
+			host = host[i+1:]
+		}
+		url = host + "/" + strings.TrimPrefix(path, "/")
+	}
+	url = strings.TrimSuffix(url, "/")
+	url = strings.TrimSuffix(url, ".git")
+	return url
+}
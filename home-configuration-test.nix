@@ -20,6 +20,9 @@ home-manager.lib.homeManagerConfiguration {
       programs.envar = {
         enable = true;
         enableBashIntegration = true;
+        enableZshIntegration = true;
+        enableFishIntegration = true;
+        enableNushellIntegration = true;
         settings = {
           vars = {
             FOO = [
@@ -37,6 +40,10 @@ home-manager.lib.homeManagerConfiguration {
           };
           execs = {
             bar = "/bin/bar";
+            baz = {
+              command = "/bin/baz";
+              ttl = "15m";
+            };
           };
         };
       };
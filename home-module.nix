@@ -25,6 +25,9 @@ in
       description = "The envar package to use.";
     };
     enableBashIntegration = lib.hm.shell.mkBashIntegrationOption { inherit config; };
+    enableZshIntegration = lib.hm.shell.mkZshIntegrationOption { inherit config; };
+    enableFishIntegration = lib.hm.shell.mkFishIntegrationOption { inherit config; };
+    enableNushellIntegration = lib.hm.shell.mkNushellIntegrationOption { inherit config; };
     settings = {
       vars = lib.mkOption {
         type =
@@ -35,10 +38,10 @@ in
               options = {
                 path = lib.mkOption {
                   type = str;
-                  description = "Path pattern to match.";
+                  description = "Path or glob pattern to match.";
                 };
                 value = lib.mkOption {
-                  type =
+                  type = nullOr (
                     either
                       (
                         # value
@@ -50,8 +53,24 @@ in
                           # args
                           either str (listOf str)
                         )
-                      );
-                  description = "Value or command to bind the variable to.";
+                      )
+                  );
+                  default = null;
+                  description = "Value or command to bind the variable to. `null` unsets the variable, and is required for exclusion paths.";
+                };
+                when = lib.mkOption {
+                  type = attrsOf (oneOf [
+                    str
+                    (listOf str)
+                    (attrsOf (nullOr (either str (listOf str))))
+                  ]);
+                  default = { };
+                  example = {
+                    host = "laptop-*";
+                    os = "linux";
+                    env.CI = null;
+                  };
+                  description = "Conditions to apply this path. Keys are `host`, `user`, `os`, `distro`, `profile` and `env`. Values are glob patterns, and `env` maps variable names to glob patterns or `null` for unset variables.";
                 };
               };
             })
@@ -60,9 +79,34 @@ in
         description = "Environment variables to set.";
       };
       execs = lib.mkOption {
-        type = with lib.types; attrsOf str;
+        type =
+          with lib.types;
+          attrsOf (
+            either str (submodule {
+              options = {
+                command = lib.mkOption {
+                  type = str;
+                  description = "Script to execute.";
+                };
+                ttl = lib.mkOption {
+                  type = nullOr str;
+                  default = null;
+                  example = "15m";
+                  description = "How long the output is reused. `null` runs the script every time.";
+                };
+              };
+            })
+          );
         default = { };
-        description = "Scripts to execute";
+        description = "Scripts to execute. A value can be an attribute set with `command` and `ttl` to reuse the output.";
+      };
+      resolution = lib.mkOption {
+        type = lib.types.enum [
+          "most-specific"
+          "first-listed"
+        ];
+        default = "most-specific";
+        description = "Which path to use when multiple paths match for a variable.";
       };
     };
   };
@@ -71,13 +115,35 @@ in
     xdg.configFile = {
       "envar/vars.yaml".text = makeVarsYamlString config'.settings.vars;
       "envar/execs.yaml".source = yamlFormat.generate "envar-execs.yaml" config'.settings.execs;
+      "envar/settings.yaml".source = yamlFormat.generate "envar-settings.yaml" {
+        inherit (config'.settings) resolution;
+      };
     };
     programs.bash = lib.mkIf config'.enableBashIntegration {
       initExtra = ''
         eval "$(${config'.package}/bin/envar hook)"
       '';
       logoutExtra = ''
-        ${config'.package}/bin/envar hook logout $$
+        ${config'.package}/bin/envar hook logout "$ENVAR_SESSION"
+      '';
+    };
+    programs.zsh = lib.mkIf config'.enableZshIntegration {
+      initContent = ''
+        eval "$(${config'.package}/bin/envar hook zsh)"
+      '';
+    };
+    programs.fish = lib.mkIf config'.enableFishIntegration {
+      interactiveShellInit = ''
+        ${config'.package}/bin/envar hook fish | source
+      '';
+    };
+    programs.nushell = lib.mkIf config'.enableNushellIntegration {
+      extraConfig = ''
+        source ${
+          pkgs.runCommand "envar-hook.nu" { } ''
+            ${config'.package}/bin/envar hook nu > $out
+          ''
+        }
       '';
     };
   };
@@ -1,12 +1,21 @@
+# シェルごとのセッション。子のシェルに引き継がないように export しない変数に持つ
+if [[ -z "${_envar_session:-}" ]]
+then
+  _envar_session="$(envar session new $$)"
+fi
+# envar profile などのコマンドがセッションを見つけられるように公開する
+export ENVAR_SESSION="$_envar_session"
+
 _envar() {
   local previous_exit_status=$?
   # Control-C を一旦無効に
   trap -- '' SIGINT
   # envar コマンドの出力を評価して環境変数を設定・解除する
-  local script="$(envar $$)"
+  local script="$(envar "$_envar_session")"
   if [[ -n "$script" ]]
   then
-    echo "$script" | sed -E 's/^export ([^=]+).*/export \1/'| sed 's/^/envar: /'
+    # 値は表示しない。値が複数行の場合の 2 行目以降も表示しない
+    echo "$script" | grep -E '^(export|unset) ' | sed -E 's/^export ([^=]+).*/export \1/'| sed 's/^/envar: /'
     eval "$script"
   fi
   # Control-C を元に戻す
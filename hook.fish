@@ -0,0 +1,22 @@
+# シェルごとのセッション。子のシェルに引き継がないように export しない変数に持つ
+if not set -q _envar_session
+    set -g _envar_session (envar session new $fish_pid)
+end
+# envar profile などのコマンドがセッションを見つけられるように公開する
+set -gx ENVAR_SESSION $_envar_session
+
+function _envar --on-variable PWD --on-event fish_prompt
+    set -l previous_status $status
+    # envar コマンドの出力を評価して環境変数を設定・解除する
+    set -l script (envar $_envar_session fish)
+    if test (count $script) -gt 0
+        # 値は表示しない。値が複数行の場合の 2 行目以降も表示しない
+        string match -r '^set -(?:gx|e) \S+' -- $script | string replace -r '^' 'envar: '
+        string join \n -- $script | source
+    end
+    return $previous_status
+end
+
+function _envar_logout --on-event fish_exit
+    envar hook logout $_envar_session
+end
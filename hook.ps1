@@ -0,0 +1,30 @@
+if (-not (Test-Path Variable:global:_envarOriginalPrompt)) {
+  $global:_envarOriginalPrompt = $function:prompt
+  # シェルごとのセッション
+  $global:_envarSession = (& envar session new $PID)
+  # envar profile などのコマンドがセッションを見つけられるように公開する
+  $env:ENVAR_SESSION = $global:_envarSession
+
+  function global:prompt {
+    $previousExitCode = $global:LASTEXITCODE
+    # Control-C を一旦無効に
+    $previousTreatControlCAsInput = [Console]::TreatControlCAsInput
+    [Console]::TreatControlCAsInput = $true
+    try {
+      # envar コマンドの出力を評価して環境変数を設定・解除する
+      $script = (& envar $global:_envarSession pwsh) -join "`n"
+      if ($script) {
+        # 値は表示しない。値が複数行の場合の 2 行目以降も表示しない
+        $script -split "`n" | Where-Object { $_ -match '^(\$env:\S+ = |Remove-Item Env:)' } | ForEach-Object { 'envar: ' + ($_ -replace '^(\$env:\S+) = .*$', '$1') } | Write-Host
+        Invoke-Expression $script
+      }
+    } finally {
+      # Control-C を元に戻す
+      [Console]::TreatControlCAsInput = $previousTreatControlCAsInput
+    }
+    $global:LASTEXITCODE = $previousExitCode
+    & $global:_envarOriginalPrompt
+  }
+
+  $null = Register-EngineEvent -SourceIdentifier PowerShell.Exiting -Action { & envar hook logout $global:_envarSession }
+}
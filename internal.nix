@@ -9,20 +9,35 @@ rec {
           [ "${varName}:" ]
           ++ lib.map (
             pattern:
-            if lib.isAttrs pattern.value then
-              [ "${pattern.path}:" ]
+            if pattern.when != { } then
+              [
+                "${builtins.toJSON pattern.path}:"
+                (
+                  lib.optional (pattern.value != null) (
+                    if lib.isAttrs pattern.value then
+                      "exec: ${builtins.toJSON pattern.value}"
+                    else
+                      "value: ${builtins.toJSON pattern.value}"
+                  )
+                  ++ [ "when: ${builtins.toJSON pattern.when}" ]
+                )
+              ]
+            else if pattern.value == null then
+              [ "${builtins.toJSON pattern.path}:" ]
+            else if lib.isAttrs pattern.value then
+              [ "${builtins.toJSON pattern.path}:" ]
               ++ lib.mapAttrsToList (
                 command: args:
                 if lib.isList args then
                   [
                     "${command}:"
-                    (lib.map (a: "- \"${a}\"") args)
+                    (lib.map (a: "- ${builtins.toJSON a}") args)
                   ]
                 else
-                  [ "${command}: \"${args}\"" ]
+                  [ "${command}: ${builtins.toJSON args}" ]
               ) pattern.value
             else
-              [ "${pattern.path}: \"${pattern.value}\"" ]
+              [ "${builtins.toJSON pattern.path}: ${builtins.toJSON pattern.value}" ]
           ) patterns
         ) vars
       );
@@ -1,16 +1,21 @@
 package main
 
 import (
-	_ "embed"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	"go.yaml.in/yaml/v4"
@@ -25,6 +30,69 @@ func main() {
 	switch os.Args[1] {
 	case "help":
 		fmt.Print(usageMessage)
+	case "explain":
+		if len(os.Args) != 2 && len(os.Args) != 3 {
+			log.Fatalf("invalid number of arguments for explain: %d", len(os.Args)-1)
+		}
+		explain(parseSessionId(os.Args[2:]))
+	case "profile":
+		if len(os.Args) < 3 {
+			log.Fatalf("invalid number of arguments for profile: %d", len(os.Args)-1)
+		}
+		switch os.Args[2] {
+		case "use":
+			if len(os.Args) != 4 && len(os.Args) != 5 {
+				log.Fatalf("invalid number of arguments for profile use: %d", len(os.Args)-1)
+			}
+			profile := os.Args[3]
+			if profile == "" {
+				log.Fatalf("profile name must not be empty")
+			}
+			writeProfile(parseSessionId(os.Args[4:]), profile)
+		case "clear":
+			if len(os.Args) != 3 && len(os.Args) != 4 {
+				log.Fatalf("invalid number of arguments for profile clear: %d", len(os.Args)-1)
+			}
+			writeProfile(parseSessionId(os.Args[3:]), "")
+		case "show":
+			if len(os.Args) != 3 && len(os.Args) != 4 {
+				log.Fatalf("invalid number of arguments for profile show: %d", len(os.Args)-1)
+			}
+			profile := readProfile(parseSessionId(os.Args[3:]))
+			if profile != "" {
+				fmt.Println(profile)
+			}
+		default:
+			log.Fatalf("unknown profile command: %s", os.Args[2])
+		}
+	case "session":
+		if len(os.Args) != 4 || os.Args[2] != "new" {
+			log.Fatalf("give the shell PID to session new")
+		}
+		shellPid, err := strconv.ParseUint(os.Args[3], 10, 32)
+		if err != nil {
+			log.Fatalf("invalid shell PID: %s", os.Args[3])
+		}
+		fmt.Println(newSession(uint(shellPid)))
+	case "reload":
+		if len(os.Args) != 2 && len(os.Args) != 3 {
+			log.Fatalf("invalid number of arguments for reload: %d", len(os.Args)-1)
+		}
+		reloadSession(parseSessionId(os.Args[2:]))
+	case "cache":
+		if len(os.Args) != 3 || os.Args[2] != "clear" {
+			log.Fatalf("unknown cache command: %s", strings.Join(os.Args[2:], " "))
+		}
+		if err := clearExecCache(); err != nil {
+			log.Fatal(fmt.Errorf("failed to clear the cache, because %w", err))
+		}
+	case "gc":
+		if len(os.Args) != 2 {
+			log.Fatalf("invalid number of arguments for gc: %d", len(os.Args)-1)
+		}
+		if err := collectGarbage(); err != nil {
+			log.Fatal(fmt.Errorf("failed to collect garbage, because %w", err))
+		}
 	case "path":
 		if len(os.Args) != 3 {
 			log.Fatalf("invalid number of arguments for path: %d", len(os.Args)-1)
@@ -41,40 +109,123 @@ func main() {
 	case "hook":
 		switch len(os.Args) {
 		case 2:
-			fmt.Print(hookScript)
+			fmt.Print(hookScripts["bash"])
+		case 3:
+			script, ok := hookScripts[os.Args[2]]
+			if !ok {
+				log.Fatalf("unknown shell: %s", os.Args[2])
+			}
+			fmt.Print(script)
 		case 4:
 			if os.Args[2] != "logout" {
 				log.Fatalf("unknown hook type: %s", os.Args[2])
 			}
-			shellPid, err := strconv.ParseUint(os.Args[3], 10, 32)
-			if err != nil {
-				log.Fatalf("invalid shell PID: %s", os.Args[3])
-			}
-			cachePath := makeCachedScriptPath(uint(shellPid))
-			err = os.Remove(cachePath)
-			if err != nil && !os.IsNotExist(err) {
-				log.Fatal(fmt.Errorf("failed to remove cache file: %s, because %w", cachePath, err))
+			if !isValidSessionId(os.Args[3]) {
+				log.Fatalf("invalid session: %s", os.Args[3])
 			}
+			removeSessionFiles(os.Args[3])
 		default:
 			log.Fatalf("invalid number of arguments for hook: %d", len(os.Args)-1)
 		}
 	default:
-		if len(os.Args) != 2 {
-			log.Fatalf("give the shell PID")
+		if len(os.Args) != 2 && len(os.Args) != 3 {
+			log.Fatalf("give the session or the shell PID")
 		}
-		shellPid, err := strconv.ParseUint(os.Args[1], 10, 32)
-		if err != nil {
-			log.Fatalf("invalid shell PID: %s", os.Args[1])
+		if !isValidSessionId(os.Args[1]) {
+			log.Fatalf("invalid session: %s", os.Args[1])
+		}
+		shell := "bash"
+		if len(os.Args) == 3 {
+			shell = os.Args[2]
 		}
-		doMain(uint(shellPid))
+		syntax, ok := shellSyntaxes[shell]
+		if !ok {
+			log.Fatalf("unknown shell: %s", shell)
+		}
+		doMain(os.Args[1], syntax)
 	}
 }
 
-func doMain(shellPid uint) {
-	varsConfig, execsConfig, err := readConfigs()
+func doMain(session SessionId, syntax ShellSyntax) {
+	configs, err := readConfigs()
 	if err != nil {
 		log.Fatal(fmt.Errorf("failed to read configs, because %w", err))
 	}
+	unlock := lockSession(session)
+	defer unlock()
+	resetSessionIfReused(session)
+	key := readCacheKey()
+	snapshot := readSnapshot(session, key)
+	context := makeMatchContext(snapshot)
+	context.Profile = readProfile(session)
+	previousCache := readCache(session)
+	state, err := makeState(key, configs, context)
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to make the state, because %w", err))
+	}
+	if previousCache.State == state {
+		// 前回から何も変わっていなければ exec も含めて評価し直さない
+		// Nushell のフックは空のレコードを受け取る必要がある
+		fmt.Print(syntax.Script(nil))
+		collectGarbageOccasionally()
+		return
+	}
+	assignments := make([]Assignment, 0)
+	for varName, pathItems := range *configs.Vars {
+		context.Warn = func(pathItem *PathItem, err error) {
+			log.Print(fmt.Errorf("skipped path '%s' for %s, because %w", pathItem.Path, varName, err))
+		}
+		match, err := resolvePathItem(pathItems, context, configs.Settings.Resolution)
+		if err != nil {
+			log.Fatal(fmt.Errorf("failed to resolve a path for %s, because %w", varName, err))
+		}
+		if match == nil {
+			// No match found for this variable, restore the value before envar set it
+			if original, ok := snapshot[varName]; ok {
+				assignments = append(assignments, Assignment{Name: varName, Value: original})
+				delete(snapshot, varName)
+			}
+			continue
+		}
+		takeSnapshot(snapshot, varName)
+		if match.PathItem.Exec != nil {
+			execConfig, ok := (*configs.Execs)[match.PathItem.Exec.Id]
+			if !ok {
+				log.Fatal(fmt.Errorf("exec reference '%s' not found in execs.yaml for variable %s", match.PathItem.Exec.Id, varName))
+			}
+			args := make([]string, 0, len(match.PathItem.Exec.Args))
+			for _, arg := range match.PathItem.Exec.Args {
+				args = append(args, match.ExpandQuoted(arg, quotePosix))
+			}
+			v, err := runCachedExecCommand(key, match.PathItem.Exec.Id, execConfig, args)
+			if err != nil {
+				log.Fatal(fmt.Errorf("failed to run exec for %s, because %w", varName, err))
+			}
+			assignments = append(assignments, Assignment{Name: varName, Value: &v})
+		} else if match.PathItem.Value == nil {
+			assignments = append(assignments, Assignment{Name: varName, Value: nil})
+		} else {
+			v := match.Expand(*match.PathItem.Value)
+			assignments = append(assignments, Assignment{Name: varName, Value: &v})
+		}
+	}
+	assignments = append(assignments, restoreRemovedVars(snapshot, configs.Vars)...)
+	cache := &Cache{State: state, Fingerprints: make([]string, 0, len(assignments))}
+	changes := make([]Assignment, 0)
+	for _, assignment := range assignments {
+		fingerprint := fingerprintAssignment(key, assignment)
+		cache.Fingerprints = append(cache.Fingerprints, fingerprint)
+		if !slices.Contains(previousCache.Fingerprints, fingerprint) {
+			changes = append(changes, assignment)
+		}
+	}
+	fmt.Print(syntax.Script(changes))
+	writeCache(session, cache)
+	writeSnapshot(session, key, snapshot)
+	collectGarbageOccasionally()
+}
+
+func makeMatchContext(snapshot Snapshot) MatchContext {
 	workingDirectory, err := os.Getwd()
 	if err != nil {
 		log.Fatal(fmt.Errorf("failed to get working directory, because %w", err))
@@ -83,47 +234,111 @@ func doMain(shellPid uint) {
 	if err != nil {
 		log.Fatal(fmt.Errorf("failed to get user home directory, because %w", err))
 	}
-	script := make([]string, 0)
-	for varName, pathItems := range *varsConfig {
-		for _, pathItem := range pathItems {
+	realWorkingDirectory, err := filepath.EvalSymlinks(workingDirectory)
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to resolve symbolic links of working directory, because %w", err))
+	}
+	gitRepository, err := findGitRepository(workingDirectory)
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to find git repository, because %w", err))
+	}
+	machine, err := readMachine()
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to read machine information, because %w", err))
+	}
+	return MatchContext{
+		WorkingDirectory:     workingDirectory,
+		RealWorkingDirectory: realWorkingDirectory,
+		HomeDir:              homeDir,
+		Environment:          readEnvironmentBeforeEnvar(snapshot),
+		GitRepository:        gitRepository,
+		Machine:              *machine,
+	}
+}
+
+// explain は各変数についてどの規則がなぜ選ばれたか、あるいは選ばれなかったかを表示する
+func explain(session SessionId) {
+	configs, err := readConfigs()
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to read configs, because %w", err))
+	}
+	snapshot := readSnapshot(session, readCacheKey())
+	context := makeMatchContext(snapshot)
+	context.Profile = readProfile(session)
+	varNames := slices.Sorted(maps.Keys(*configs.Vars))
+	for _, varName := range varNames {
+		fmt.Printf("%s:\n", varName)
+		context.Explain = func(pathItem *PathItem, message string) {
 			path := pathItem.Path
-			path = strings.Replace(path, "~", homeDir, 1)
-			matched := strings.HasPrefix(workingDirectory, path)
-			if matched {
-				if pathItem.Exec != nil {
-					commandTemplate, ok := (*execsConfig)[pathItem.Exec.Id]
-					if !ok {
-						log.Fatal(fmt.Errorf("exec reference '%s' not found in execs.yaml for variable %s", pathItem.Exec.Id, varName))
-					}
-					v, err := runExecCommand(commandTemplate, pathItem.Exec.Args)
-					if err != nil {
-						log.Fatal(fmt.Errorf("failed to run exec for %s, because %w", varName, err))
-					}
-					script = append(script, fmt.Sprintf("export %s=%s", varName, v))
-				} else if pathItem.Value == nil {
-					script = append(script, fmt.Sprintf("unset %s", varName))
-				} else {
-					script = append(script, fmt.Sprintf("export %s=%s", varName, *pathItem.Value))
-				}
-				goto nextVar
+			if pathItem.Exclude {
+				path = excludePathPrefix + path
 			}
+			fmt.Printf("  %s: %s\n", path, message)
 		}
-		// No match found for this variable, unset it
-		script = append(script, fmt.Sprintf("unset %s", varName))
-	nextVar:
+		match, err := resolvePathItem((*configs.Vars)[varName], context, configs.Settings.Resolution)
+		if err != nil {
+			log.Fatal(fmt.Errorf("failed to resolve a path for %s, because %w", varName, err))
+		}
+		if match == nil {
+			if _, ok := snapshot[varName]; ok {
+				fmt.Printf("  => no path matches, so the value before envar set it is restored\n")
+			} else {
+				fmt.Printf("  => no path matches, so it is left as it is\n")
+			}
+		} else {
+			fmt.Printf("  => %s is used\n", match.PathItem.Path)
+		}
+	}
+}
+
+func readMachine() (*Machine, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host name, because %w", err)
+	}
+	currentUser, err := user.Current()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current user, because %w", err)
+	}
+	distro, err := readDistro()
+	if err != nil {
+		return nil, err
+	}
+	return &Machine{Host: host, User: currentUser.Username, OS: runtime.GOOS, Distro: distro}, nil
+}
+
+func readEnvironment() map[string]string {
+	environment := make(map[string]string)
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		environment[name] = value
 	}
-	previousScript := readCachedScript(shellPid)
-	for _, line := range script {
-		if !slices.Contains(previousScript, line) {
-			fmt.Println(line)
+	return environment
+}
+
+// readEnvironmentBeforeEnvar は環境変数を読み、envar が設定した変数は設定する前の値にする
+// envar が設定した今の値は前回の結果なので、条件や展開には使わない
+func readEnvironmentBeforeEnvar(snapshot Snapshot) map[string]string {
+	environment := readEnvironment()
+	for varName, original := range snapshot {
+		if original == nil {
+			delete(environment, varName)
+		} else {
+			environment[varName] = *original
 		}
 	}
-	writeCachedScript(shellPid, script)
+	return environment
+}
+
+// Assignment は 1 つの環境変数に対する設定または解除
+type Assignment struct {
+	Name  VarName
+	Value *string // nil means unset
 }
 
 type VarsConfig = map[VarName][]PathItem
 
-type ExecsConfig = map[ExecId]ExecPattern
+type ExecsConfig = map[ExecId]ExecConfig
 
 type VarName = string
 
@@ -131,35 +346,75 @@ type ExecId = string
 
 type ExecPattern = string
 
+// ExecConfig はコマンドテンプレートと、結果を使い回す期間
+type ExecConfig struct {
+	Command ExecPattern
+	TTL     time.Duration // 0 means the result is not cached
+}
+
 type PathItem struct {
-	Path  string
-	Value *string   // nil means unset
-	Exec  *ExecItem // optional reference to exec command
+	Path      string
+	Regexp    *regexp.Regexp // compiled when Path has the re: prefix
+	Exclude   bool           // true when the path had the ! prefix
+	Value     *string        // nil means unset
+	Exec      *ExecItem      // optional reference to exec command
+	Condition *Condition     // optional condition to apply this item
 }
 
+const (
+	regexpPathPrefix  = "re:"
+	gitPathPrefix     = "git:"
+	markerPathPrefix  = "marker:"
+	excludePathPrefix = "!"
+)
+
 type ExecItem struct {
 	Id   ExecId
 	Args []string
 }
 
-func readConfigs() (*VarsConfig, *ExecsConfig, error) {
+type Configs struct {
+	Vars     *VarsConfig
+	Execs    *ExecsConfig
+	Settings *Settings
+	// Digest は設定ファイルの内容のハッシュ
+	Digest [sha256.Size]byte
+}
+
+func readConfigs() (*Configs, error) {
 	varsBytes, err := readConfig("vars.yaml")
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read vars config, because %w", err)
+		return nil, fmt.Errorf("failed to read vars config, because %w", err)
 	}
 	execsBytes, err := readConfig("execs.yaml")
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read execs config, because %w", err)
+		return nil, fmt.Errorf("failed to read execs config, because %w", err)
+	}
+	settingsBytes, err := readConfig("settings.yaml")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read settings, because %w", err)
 	}
 	config, err := UnmarshalVarsConfig(varsBytes)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to unmarshal vars config, because %w", err)
+		return nil, fmt.Errorf("failed to unmarshal vars config, because %w", err)
 	}
 	execsConfig, err := UnmarshalExecsConfig(execsBytes)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to unmarshal execs config, because %w", err)
+		return nil, fmt.Errorf("failed to unmarshal execs config, because %w", err)
+	}
+	settings, err := UnmarshalSettings(settingsBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal settings, because %w", err)
+	}
+	digest := sha256.New()
+	for _, bytes := range [][]byte{varsBytes, execsBytes, settingsBytes} {
+		digest.Write([]byte(strconv.Itoa(len(bytes))))
+		digest.Write([]byte{0})
+		digest.Write(bytes)
 	}
-	return config, execsConfig, nil
+	configs := &Configs{Vars: config, Execs: execsConfig, Settings: settings}
+	digest.Sum(configs.Digest[:0])
+	return configs, nil
 }
 
 func readConfig(fileName string) ([]byte, error) {
@@ -168,7 +423,7 @@ func readConfig(fileName string) ([]byte, error) {
 		return nil, fmt.Errorf("failed to get user config dir, because %w", err)
 	}
 	path := filepath.Join(configDir, appName, fileName)
-	file, err := openFileAndCreateIfNecessaryRecursive(path, os.O_RDONLY, 0777)
+	file, err := openFileAndCreateIfNecessaryRecursive(path, os.O_RDONLY, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open vars config: %s, because %w", path, err)
 	}
@@ -212,6 +467,9 @@ func UnmarshalVarsConfig(bytes []byte) (*VarsConfig, error) {
 		if varName == "" {
 			return nil, fmt.Errorf("variable name must not be empty")
 		}
+		if !isValidVarName(varName) {
+			return nil, fmt.Errorf("variable name must consist of ASCII letters, digits and underscores and must not start with a digit: '%s'", varName)
+		}
 		if _, ok := cfg[varName]; !ok {
 			cfg[varName] = make([]PathItem, 0)
 		}
@@ -234,54 +492,173 @@ func UnmarshalVarsConfig(bytes []byte) (*VarsConfig, error) {
 				return nil, fmt.Errorf("path must not be empty under '%s'", varName)
 			}
 			var pathItem PathItem
+			if excluded, ok := strings.CutPrefix(path, excludePathPrefix); ok {
+				pathItem.Exclude = true
+				path = excluded
+			}
 			pathItem.Path = path
-			switch pv.Kind {
-			case yaml.ScalarNode:
-				// 値がリテラルで書かれているか null が期待される
-				if pv.Tag == "!!null" || strings.TrimSpace(pv.Value) == "" {
-					pathItem.Value = nil
-				} else {
-					val := pv.Value
+			if marker, ok := strings.CutPrefix(path, markerPathPrefix); ok {
+				if !filepath.IsLocal(marker) {
+					return nil, fmt.Errorf("marker must be a non-empty relative path without '..' under '%s': '%s'", varName, marker)
+				}
+			} else if pattern, ok := strings.CutPrefix(path, gitPathPrefix); ok {
+				if err := validateGlobPattern(pattern); err != nil {
+					return nil, fmt.Errorf("invalid git remote pattern '%s' under '%s', because %w", pattern, varName, err)
+				}
+			} else if pattern, ok := strings.CutPrefix(path, regexpPathPrefix); ok {
+				re, err := regexp.Compile(pattern)
+				if err != nil {
+					return nil, fmt.Errorf("invalid regular expression '%s' under '%s', because %w", pattern, varName, err)
+				}
+				pathItem.Regexp = re
+			} else if err := validatePathPattern(path); err != nil {
+				return nil, fmt.Errorf("invalid path pattern '%s' under '%s', because %w", path, varName, err)
+			}
+			pathItems, err := unmarshalPathValue(pv, pathItem)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value under path '%s' of '%s', because %w", path, varName, err)
+			}
+			cfg[varName] = append(cfg[varName], pathItems...)
+		}
+	}
+
+	return &cfg, nil
+}
+
+// unmarshalPathValue はパスの値を解析する。配列の場合は上から順に複数の規則になる
+func unmarshalPathValue(node *yaml.Node, base PathItem) ([]PathItem, error) {
+	if node.Kind == yaml.SequenceNode {
+		pathItems := make([]PathItem, 0, len(node.Content))
+		for _, elementNode := range node.Content {
+			if elementNode.Kind == yaml.SequenceNode {
+				return nil, fmt.Errorf("alternatives must not be nested")
+			}
+			elementPathItems, err := unmarshalPathValue(elementNode, base)
+			if err != nil {
+				return nil, err
+			}
+			pathItems = append(pathItems, elementPathItems...)
+		}
+		return pathItems, nil
+	}
+	pathItem := base
+	switch node.Kind {
+	case yaml.ScalarNode:
+		// 値がリテラルで書かれているか null が期待される
+		if node.Tag == "!!null" || strings.TrimSpace(node.Value) == "" {
+			pathItem.Value = nil
+		} else {
+			val := node.Value
+			pathItem.Value = &val
+		}
+	case yaml.MappingNode:
+		if !isRuleMapping(node) {
+			// ExecId → 引数 が期待される
+			exec, err := unmarshalExecItem(node)
+			if err != nil {
+				return nil, err
+			}
+			pathItem.Exec = exec
+			break
+		}
+		// value、exec、when をキーに持つ規則
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			k := node.Content[i]
+			v := node.Content[i+1]
+			switch k.Value {
+			case "value":
+				if v.Kind != yaml.ScalarNode {
+					return nil, fmt.Errorf("value must be a scalar, got kind: %v", v.Kind)
+				}
+				if v.Tag != "!!null" && strings.TrimSpace(v.Value) != "" {
+					val := v.Value
 					pathItem.Value = &val
 				}
-			case yaml.MappingNode:
-				// ExecId → 引数 が期待される
-				if len(pv.Content) != 2 {
-					return nil, fmt.Errorf("nested mapping under path '%s' must have exactly one key-value pair", path)
+			case "exec":
+				if v.Kind != yaml.MappingNode {
+					return nil, fmt.Errorf("exec must be a mapping, got kind: %v", v.Kind)
 				}
-				nk := pv.Content[0]
-				nv := pv.Content[1]
-				if nk.Kind != yaml.ScalarNode {
-					return nil, fmt.Errorf("exec reference key must be a scalar under path '%s'", path)
+				exec, err := unmarshalExecItem(v)
+				if err != nil {
+					return nil, err
 				}
-				execName := nk.Value
-				pathItem.Value = nil
-				pathItem.Exec = &ExecItem{Id: execName}
-				pathItem.Exec.Args = make([]string, 0, len(nv.Content))
-				// 引数の解析
-				switch nv.Kind {
-				case yaml.ScalarNode:
-					// 単一引数
-					pathItem.Exec.Args = append(pathItem.Exec.Args, nv.Value)
-				case yaml.SequenceNode:
-					// 配列引数
-					for _, argNode := range nv.Content {
-						if argNode.Kind != yaml.ScalarNode {
-							return nil, fmt.Errorf("exec arguments must be scalars under path '%s'", path)
-						}
-						pathItem.Exec.Args = append(pathItem.Exec.Args, argNode.Value)
-					}
-				default:
-					return nil, fmt.Errorf("exec argument must be a scalar or array under path '%s'", path)
+				pathItem.Exec = exec
+			case "when":
+				condition, err := unmarshalCondition(v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid condition, because %w", err)
 				}
+				pathItem.Condition = condition
 			default:
-				return nil, fmt.Errorf("unsupported value node kind under path '%s': %v", path, pv.Kind)
+				return nil, fmt.Errorf("unknown key: '%s'", k.Value)
+			}
+		}
+		if pathItem.Value != nil && pathItem.Exec != nil {
+			return nil, fmt.Errorf("value and exec must not be specified together")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported value node kind: %v", node.Kind)
+	}
+	// 除外の規則は値を持たない
+	if pathItem.Exclude && (pathItem.Value != nil || pathItem.Exec != nil) {
+		return nil, fmt.Errorf("exclusion path must not have a value")
+	}
+	return []PathItem{pathItem}, nil
+}
+
+var ruleKeys = []string{"value", "exec", "when"}
+
+// isRuleMapping は value、exec、when のいずれかをキーに持つ規則の書き方かを判定する
+// そうでなければ ExecId → 引数 の省略した書き方
+func isRuleMapping(node *yaml.Node) bool {
+	for i := 0; i < len(node.Content); i += 2 {
+		if slices.Contains(ruleKeys, node.Content[i].Value) {
+			return true
+		}
+	}
+	return false
+}
+
+func unmarshalExecItem(node *yaml.Node) (*ExecItem, error) {
+	if len(node.Content) != 2 {
+		return nil, fmt.Errorf("nested mapping must have exactly one key-value pair")
+	}
+	nk := node.Content[0]
+	nv := node.Content[1]
+	if nk.Kind != yaml.ScalarNode {
+		return nil, fmt.Errorf("exec reference key must be a scalar")
+	}
+	exec := &ExecItem{Id: nk.Value}
+	exec.Args = make([]string, 0, len(nv.Content))
+	// 引数の解析
+	switch nv.Kind {
+	case yaml.ScalarNode:
+		// 単一引数
+		exec.Args = append(exec.Args, nv.Value)
+	case yaml.SequenceNode:
+		// 配列引数
+		for _, argNode := range nv.Content {
+			if argNode.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("exec arguments must be scalars")
 			}
-			cfg[varName] = append(cfg[varName], pathItem)
+			exec.Args = append(exec.Args, argNode.Value)
 		}
+	default:
+		return nil, fmt.Errorf("exec argument must be a scalar or array")
 	}
+	return exec, nil
+}
 
-	return &cfg, nil
+func isValidVarName(varName VarName) bool {
+	for i, r := range varName {
+		switch {
+		case r == '_', 'A' <= r && r <= 'Z', 'a' <= r && r <= 'z':
+		case '0' <= r && r <= '9' && i != 0:
+		default:
+			return false
+		}
+	}
+	return varName != ""
 }
 
 func UnmarshalExecsConfig(bytes []byte) (*ExecsConfig, error) {
@@ -312,56 +689,140 @@ func UnmarshalExecsConfig(bytes []byte) (*ExecsConfig, error) {
 		if k.Kind != yaml.ScalarNode {
 			return nil, fmt.Errorf("exec name must be a scalar, got kind: %v", k.Kind)
 		}
-		if v.Kind != yaml.ScalarNode {
-			return nil, fmt.Errorf("exec command must be a scalar, got kind: %v", v.Kind)
-		}
 		execName := strings.TrimSpace(k.Value)
 		if execName == "" {
 			return nil, fmt.Errorf("exec name must not be empty")
 		}
-		cfg[execName] = v.Value
+		execConfig, err := unmarshalExecConfig(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exec: %s, because %w", execName, err)
+		}
+		cfg[execName] = *execConfig
 	}
 	return &cfg, nil
 }
 
-func makeCachedScriptPath(shellPid uint) string {
-	cacheDir, err := os.UserCacheDir()
-	if err != nil {
-		log.Fatal(fmt.Errorf("failed to get user cache dir, because %w", err))
+// unmarshalExecConfig はコマンドテンプレートのみか、command と ttl を持つ mapping を解析する
+func unmarshalExecConfig(node *yaml.Node) (*ExecConfig, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return &ExecConfig{Command: node.Value}, nil
+	case yaml.MappingNode:
+		execConfig := &ExecConfig{}
+		hasCommand := false
+		for i := 0; i < len(node.Content); i += 2 {
+			k := node.Content[i]
+			v := node.Content[i+1]
+			switch k.Value {
+			case "command":
+				if v.Kind != yaml.ScalarNode {
+					return nil, fmt.Errorf("exec command must be a scalar, got kind: %v", v.Kind)
+				}
+				execConfig.Command = v.Value
+				hasCommand = true
+			case "ttl":
+				if v.Kind != yaml.ScalarNode {
+					return nil, fmt.Errorf("ttl must be a scalar, got kind: %v", v.Kind)
+				}
+				// null は結果を使い回さない
+				if v.Tag == "!!null" {
+					continue
+				}
+				ttl, err := time.ParseDuration(v.Value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid ttl: '%s', because %w", v.Value, err)
+				}
+				if ttl < 0 {
+					return nil, fmt.Errorf("ttl must not be negative: '%s'", v.Value)
+				}
+				execConfig.TTL = ttl
+			default:
+				return nil, fmt.Errorf("unknown key: '%s'", k.Value)
+			}
+		}
+		if !hasCommand {
+			return nil, fmt.Errorf("exec must have a command")
+		}
+		return execConfig, nil
+	default:
+		return nil, fmt.Errorf("exec must be a scalar or a mapping, got kind: %v", node.Kind)
 	}
-	return filepath.Join(cacheDir, appName, fmt.Sprintf("script.%d.bash", shellPid))
 }
 
-func readCachedScript(shellPid uint) []string {
-	cachePath := makeCachedScriptPath(shellPid)
-	cacheFile, err := openFileAndCreateIfNecessaryRecursive(cachePath, os.O_RDONLY, 0777)
-	if err != nil {
-		log.Fatal(fmt.Errorf("failed to open a cache file: %s, because %w", cachePath, err))
+type Settings struct {
+	Resolution Resolution
+}
+
+// Resolution は 1 つの変数に複数のパスが合致したときにどれを選ぶか
+type Resolution = string
+
+const (
+	// 最も深いパスを選ぶ
+	ResolutionMostSpecific Resolution = "most-specific"
+	// 最初に書かれたパスを選ぶ
+	ResolutionFirstListed Resolution = "first-listed"
+)
+
+func UnmarshalSettings(bytes []byte) (*Settings, error) {
+	if !utf8.Valid(bytes) {
+		return nil, fmt.Errorf("settings is invalid UTF-8")
 	}
-	defer cacheFile.Close()
-	cacheBytes, err := io.ReadAll(cacheFile)
-	if err != nil && err != io.EOF {
-		log.Fatal(fmt.Errorf("failed to read a cache file: %s, because %w", cachePath, err))
+	settings := Settings{
+		Resolution: ResolutionMostSpecific,
+	}
+	// 空入力は既定値として扱う
+	if strings.TrimSpace(string(bytes)) == "" {
+		return &settings, nil
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(bytes, &root); err != nil {
+		return nil, fmt.Errorf("failed to parse yaml: %w", err)
+	}
+	// DocumentNode の直下を取得
+	if len(root.Content) == 0 {
+		return &settings, nil
 	}
-	if !utf8.Valid(cacheBytes) {
-		log.Fatal(fmt.Errorf("cache file is not valid UTF-8: %s", cachePath))
+	top := root.Content[0]
+	if top.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("top-level yaml must be a mapping")
 	}
-	cacheStr := string(cacheBytes)
-	return strings.Split(cacheStr, "\n")
+	for i := 0; i < len(top.Content); i += 2 {
+		k := top.Content[i]
+		v := top.Content[i+1]
+		if k.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("setting name must be a scalar, got kind: %v", k.Kind)
+		}
+		switch k.Value {
+		case "resolution":
+			if v.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("resolution must be a scalar, got kind: %v", v.Kind)
+			}
+			switch v.Value {
+			case ResolutionMostSpecific, ResolutionFirstListed:
+				settings.Resolution = v.Value
+			default:
+				return nil, fmt.Errorf("resolution must be '%s' or '%s', got: '%s'", ResolutionMostSpecific, ResolutionFirstListed, v.Value)
+			}
+		default:
+			return nil, fmt.Errorf("unknown setting: '%s'", k.Value)
+		}
+	}
+	return &settings, nil
 }
 
-func writeCachedScript(shellPid uint, script []string) {
-	cachePath := makeCachedScriptPath(shellPid)
-	cacheFile, err := openFileAndCreateIfNecessaryRecursive(cachePath, os.O_WRONLY|os.O_TRUNC, 0777)
-	if err != nil {
-		log.Fatal(fmt.Errorf("failed to open a cache file for writing: %s, because %w", cachePath, err))
+// parseSessionId は省略されていれば ENVAR_SESSION を、それもなければ親プロセスをシェルとみなす
+func parseSessionId(args []string) SessionId {
+	if len(args) == 0 {
+		if session := os.Getenv(sessionEnvName); session != "" {
+			args = []string{session}
+		} else {
+			return strconv.Itoa(os.Getppid())
+		}
 	}
-	defer cacheFile.Close()
-	scriptStr := strings.Join(script, "\n")
-	_, err = cacheFile.WriteString(scriptStr)
-	if err != nil {
-		log.Fatal(fmt.Errorf("failed to write to cache file: %s, because %w", cachePath, err))
+	if !isValidSessionId(args[0]) {
+		log.Fatalf("invalid session: %s", args[0])
 	}
+	return args[0]
 }
 
 func openFileAndCreateIfNecessaryRecursive(path string, flag int, mode os.FileMode) (*os.File, error) {
@@ -370,7 +831,7 @@ func openFileAndCreateIfNecessaryRecursive(path string, flag int, mode os.FileMo
 		if !os.IsNotExist(err) {
 			return nil, fmt.Errorf("failed to open the file: %s, because %w", path, err)
 		} else {
-			file, err = os.Create(path)
+			file, err = os.OpenFile(path, flag|os.O_CREATE, mode)
 			if err != nil {
 				if !os.IsNotExist(err) {
 					return nil, fmt.Errorf("failed to create the file: %s, because %w", path, err)
@@ -380,7 +841,7 @@ func openFileAndCreateIfNecessaryRecursive(path string, flag int, mode os.FileMo
 				if err != nil {
 					return nil, fmt.Errorf("failed to create the directory: %s, because %w", dir, err)
 				}
-				file, err = os.Create(path)
+				file, err = os.OpenFile(path, flag|os.O_CREATE, mode)
 				if err != nil {
 					return nil, fmt.Errorf("failed to create the file after creating the directory: %s, because %w", path, err)
 				}
@@ -408,18 +869,31 @@ const usageMessage = "envar\n" +
 	"\n" +
 	"This is a command-line tool that automatically switches values of environment variables based on the current directory path.\n" +
 	"\n" +
-	"envar <shell-pid>\n" +
-	"  Outputs shell script to set/unset environment variables. Call `eval $(envar $$)`.\n" +
-	"envar hook\n" +
-	"  Outputs shell hook script. Call `eval $(envar hook)`.\n" +
-	"envar hook logout <shell-pid>\n" +
+	"envar <session> [<shell>]\n" +
+	"  Outputs shell script to set/unset environment variables. <shell> is bash (default), zsh, fish, nu or pwsh. <session> is made by `envar session new`, or the shell PID. Call `eval $(envar \"$ENVAR_SESSION\")`.\n" +
+	"envar hook [<shell>]\n" +
+	"  Outputs shell hook script. <shell> is bash (default), zsh, fish, nu or pwsh. Call `eval \"$(envar hook <shell>)\"` `envar hook fish | source` or `envar hook pwsh | Out-String | Invoke-Expression`.\n" +
+	"envar hook logout <session>\n" +
 	"  Cleans up cached data.\n" +
+	"envar session new <shell-pid>\n" +
+	"  Outputs a new session for the shell.\n" +
+	"envar explain [<session>]\n" +
+	"  Explains which path is used for each variable in the current directory, and why other paths are not.\n" +
+	"envar profile use <name> [<session>]\n" +
+	"  Uses the profile in the shell. <session> defaults to $ENVAR_SESSION, or the parent process.\n" +
+	"envar profile clear [<session>]\n" +
+	"  Stops using a profile in the shell.\n" +
+	"envar profile show [<session>]\n" +
+	"  Displays the profile used in the shell.\n" +
+	"envar reload [<session>]\n" +
+	"  Evaluates all variables again at the next prompt, even if nothing seems to have changed.\n" +
+	"envar cache clear\n" +
+	"  Removes cached outputs of commands in execs.yaml, and evaluates all variables again at the next prompt.\n" +
+	"envar gc\n" +
+	"  Removes cached data of shells which have exited. This is also done once a day automatically.\n" +
 	"envar path config\n" +
 	"  Displays the path to the configuration directory.\n" +
 	"envar help\n" +
 	"  Displays this help message.\n" +
 	"\n" +
 	"https://github.com/kakkun61/envar\n"
-
-//go:embed hook.bash
-var hookScript string
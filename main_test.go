@@ -1,8 +1,16 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestUnmarshalVarsConfigEmpty(t *testing.T) {
@@ -286,18 +294,50 @@ echo: bash -c 'echo %s and %s'
 	if !ok {
 		t.Fatalf("expected 'gh' entry to exist")
 	}
-	if ghCmd != "gh auth token --user %s" {
+	if ghCmd.Command != "gh auth token --user %s" {
 		t.Fatalf("unexpected gh command: %s", ghCmd)
 	}
 	echoCmd, ok := (*config)["echo"]
 	if !ok {
 		t.Fatalf("expected 'echo' entry to exist")
 	}
-	if echoCmd != "bash -c 'echo %s and %s'" {
+	if echoCmd.Command != "bash -c 'echo %s and %s'" {
 		t.Fatalf("unexpected echo command: %s", echoCmd)
 	}
 }
 
+func TestUnmarshalExecsConfigTTL(t *testing.T) {
+	config, err := UnmarshalExecsConfig([]byte(strings.TrimSpace(`
+gh:
+  command: gh auth token --user %s
+  ttl: 15m
+pass:
+  command: pass show %s
+  ttl: null
+	`)))
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	if gh := (*config)["gh"]; gh.Command != "gh auth token --user %s" || gh.TTL != 15*time.Minute {
+		t.Errorf("unexpected gh: %#v", gh)
+	}
+	if pass := (*config)["pass"]; pass.Command != "pass show %s" || pass.TTL != 0 {
+		t.Errorf("unexpected pass: %#v", pass)
+	}
+	invalids := []string{
+		"gh:\n  ttl: 15m\n",
+		"gh:\n  command: gh auth token\n  ttl: soon\n",
+		"gh:\n  command: gh auth token\n  ttl: -1m\n",
+		"gh:\n  command: gh auth token\n  other: 1\n",
+		"gh: [gh, auth, token]\n",
+	}
+	for _, invalid := range invalids {
+		if _, err := UnmarshalExecsConfig([]byte(invalid)); err == nil {
+			t.Errorf("expected an error for: %s", invalid)
+		}
+	}
+}
+
 func TestUnmarshalExecsConfigEmpty(t *testing.T) {
 	config, err := UnmarshalExecsConfig([]byte(""))
 	if err != nil {
@@ -307,3 +347,1201 @@ func TestUnmarshalExecsConfigEmpty(t *testing.T) {
 		t.Errorf("expected empty config, but got: %v", *config)
 	}
 }
+
+func TestQuoteFish(t *testing.T) {
+	cases := map[string]string{
+		"foo":      `'foo'`,
+		"foo bar":  `'foo bar'`,
+		"it's":     `'it\'s'`,
+		`back\sl`:  `'back\\sl'`,
+		"$HOME;ls": `'$HOME;ls'`,
+	}
+	for input, expected := range cases {
+		if actual := quoteFish(input); actual != expected {
+			t.Errorf("expected %s for %q, but got: %s", expected, input, actual)
+		}
+	}
+}
+
+func TestNuSyntaxScript(t *testing.T) {
+	value := "foo bar"
+	script := nuSyntax.Script([]Assignment{
+		{Name: "FOO_VAR", Value: &value},
+		{Name: "BAR_VAR", Value: nil},
+	})
+	expected := `{"set":{"FOO_VAR":"foo bar"},"hide":["BAR_VAR"]}` + "\n"
+	if script != expected {
+		t.Fatalf("expected %s, but got: %s", expected, script)
+	}
+}
+
+func TestQuotePwsh(t *testing.T) {
+	cases := map[string]string{
+		"foo":      `'foo'`,
+		"it's":     `'it''s'`,
+		"it’s":     `'it’’s'`,
+		"$HOME;ls": `'$HOME;ls'`,
+		"`n":       "'`n'",
+	}
+	for input, expected := range cases {
+		if actual := quotePwsh(input); actual != expected {
+			t.Errorf("expected %s for %q, but got: %s", expected, input, actual)
+		}
+	}
+}
+
+func TestQuotePosix(t *testing.T) {
+	cases := map[string]string{
+		"foo":        `'foo'`,
+		"foo bar":    `'foo bar'`,
+		"it's":       `'it'\''s'`,
+		"$HOME;`ls`": "'$HOME;`ls`'",
+	}
+	for input, expected := range cases {
+		if actual := quotePosix(input); actual != expected {
+			t.Errorf("expected %s for %q, but got: %s", expected, input, actual)
+		}
+	}
+}
+
+func TestUnmarshalVarsConfigInvalidVarName(t *testing.T) {
+	for _, varName := range []string{"FOO-VAR", "1FOO", "FOO VAR", "$(ls)"} {
+		_, err := UnmarshalVarsConfig([]byte(`"` + varName + `":
+  aaa: AAA`))
+		if err == nil {
+			t.Errorf("expected an error for %q", varName)
+		}
+	}
+}
+
+func TestIsPathUnder(t *testing.T) {
+	cases := []struct {
+		dir      string
+		base     string
+		expected bool
+	}{
+		{"/home/me/work/api", "/home/me/work/api", true},
+		{"/home/me/work/api/src", "/home/me/work/api", true},
+		{"/home/me/work/api-legacy", "/home/me/work/api", false},
+		{"/home/me/work/api/", "/home/me/work/api/", true},
+		{"/home/me/work/api/src", "/home/me/work/./api/", true},
+		{"/home/me/work", "/home/me/work/api", false},
+		{"/home/me", "/", true},
+	}
+	for _, c := range cases {
+		if actual := isPathUnder(c.dir, c.base); actual != c.expected {
+			t.Errorf("expected %v for %s under %s, but got: %v", c.expected, c.dir, c.base, actual)
+		}
+	}
+}
+
+func TestResolvePathItem(t *testing.T) {
+	pathItems := []PathItem{
+		{Path: "/work"},
+		{Path: "/work/client-a/secret-repo"},
+		{Path: "/work/client-a"},
+		{Path: "~/work"},
+	}
+	context := MatchContext{WorkingDirectory: "/work/client-a/secret-repo/src", HomeDir: "/"}
+	mostSpecific, _ := resolvePathItem(pathItems, context, ResolutionMostSpecific)
+	if mostSpecific == nil || mostSpecific.PathItem.Path != "/work/client-a/secret-repo" {
+		t.Errorf("unexpected most specific path item: %v", mostSpecific)
+	}
+	firstListed, _ := resolvePathItem(pathItems, context, ResolutionFirstListed)
+	if firstListed == nil || firstListed.PathItem.Path != "/work" {
+		t.Errorf("unexpected first listed path item: %v", firstListed)
+	}
+	context.WorkingDirectory = "/other"
+	if none, _ := resolvePathItem(pathItems, context, ResolutionMostSpecific); none != nil {
+		t.Errorf("expected no path item, but got: %v", none)
+	}
+}
+
+func TestUnmarshalSettings(t *testing.T) {
+	settings, err := UnmarshalSettings([]byte(""))
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	if settings.Resolution != ResolutionMostSpecific {
+		t.Errorf("unexpected default resolution: %s", settings.Resolution)
+	}
+	settings, err = UnmarshalSettings([]byte("resolution: first-listed"))
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	if settings.Resolution != ResolutionFirstListed {
+		t.Errorf("unexpected resolution: %s", settings.Resolution)
+	}
+	if _, err := UnmarshalSettings([]byte("resolution: random")); err == nil {
+		t.Errorf("expected an error for unknown resolution")
+	}
+}
+
+func TestMatchPathItemGlob(t *testing.T) {
+	cases := []struct {
+		pattern     string
+		dir         string
+		expected    bool
+		specificity int
+	}{
+		{"/src/*/infra", "/src/app/infra", true, 3},
+		{"/src/*/infra", "/src/app/infra/modules", true, 3},
+		{"/src/*/infra", "/src/app/other", false, 0},
+		{"/src/*/infra", "/src/a/b/infra", false, 0},
+		{"/src/**/terraform", "/src/terraform", true, 2},
+		{"/src/**/terraform", "/src/a/b/terraform/x", true, 2},
+		{"/src/**/terraform", "/src/a/b/other", false, 0},
+		{"/clients/{acme,globex}", "/clients/globex/repo", true, 2},
+		{"/clients/{acme,globex}", "/clients/initech", false, 0},
+		{"/clients/{acme,{glob,init}ex}", "/clients/initex", true, 2},
+		{"~/src/?pp", "/home/me/src/app", true, 4},
+	}
+	for _, c := range cases {
+		context := MatchContext{WorkingDirectory: c.dir, HomeDir: "/home/me"}
+		match, err := matchPathItem(&PathItem{Path: c.pattern}, context)
+		if err != nil {
+			t.Fatalf("expected no error, but got: %v", err)
+		}
+		matched, specificity := match != nil, 0
+		if matched {
+			specificity = match.Specificity
+		}
+		if matched != c.expected || specificity != c.specificity {
+			t.Errorf("expected (%v, %d) for %s in %s, but got: (%v, %d)", c.expected, c.specificity, c.pattern, c.dir, matched, specificity)
+		}
+	}
+}
+
+func TestUnmarshalVarsConfigInvalidPattern(t *testing.T) {
+	for _, pattern := range []string{"/src/[a-", "/clients/{acme,globex"} {
+		_, err := UnmarshalVarsConfig([]byte("FOO_VAR:\n  \"" + pattern + "\": AAA"))
+		if err == nil {
+			t.Errorf("expected an error for %s", pattern)
+		}
+	}
+}
+
+func TestMatchPathItemRegexp(t *testing.T) {
+	config, err := UnmarshalVarsConfig([]byte(strings.TrimSpace(`
+AWS_PROFILE:
+  "re:^/home/me/clients/(?P<client>[^/]+)": ${client}-$1
+	`)))
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	pathItem := &(*config)["AWS_PROFILE"][0]
+	match, _ := matchPathItem(pathItem, MatchContext{WorkingDirectory: "/home/me/clients/acme/repo"})
+	if match == nil {
+		t.Fatalf("expected a match")
+	}
+	if match.Specificity != 4 {
+		t.Errorf("unexpected specificity: %d", match.Specificity)
+	}
+	if value := match.Expand(*pathItem.Value); value != "acme-acme" {
+		t.Errorf("unexpected expanded value: %s", value)
+	}
+	if match, _ := matchPathItem(pathItem, MatchContext{WorkingDirectory: "/home/me/work"}); match != nil {
+		t.Errorf("expected no match, but got: %v", match)
+	}
+}
+
+func TestExpandQuotedCommandArgument(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands are run with sh")
+	}
+	config, err := UnmarshalVarsConfig([]byte(strings.TrimSpace(`
+CLIENT:
+  "re:^/clients/(?P<client>[^/]+)":
+    echo: [ "$1", "${client}-bot" ]
+	`)))
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	// ディレクトリー名にシェルの構文が含まれていてもコマンドとして実行しない
+	dir := t.TempDir()
+	t.Chdir(dir)
+	name := "a;touch PWNED;b'$(id)"
+	context := MatchContext{WorkingDirectory: "/clients/" + name + "/src"}
+	pathItem := &(*config)["CLIENT"][0]
+	match, err := matchPathItem(pathItem, context)
+	if err != nil || match == nil {
+		t.Fatalf("expected a match, but got: %v, %v", match, err)
+	}
+	args := make([]string, 0, len(pathItem.Exec.Args))
+	for _, arg := range pathItem.Exec.Args {
+		args = append(args, match.ExpandQuoted(arg, quotePosix))
+	}
+	output, err := runExecCommand("echo %s; echo %s", args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != name+"\n"+name+"-bot" {
+		t.Errorf("unexpected output: %s", output)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "PWNED")); !os.IsNotExist(err) {
+		t.Error("a directory name must not be run as a command")
+	}
+}
+
+func TestUnmarshalVarsConfigInvalidRegexp(t *testing.T) {
+	_, err := UnmarshalVarsConfig([]byte("FOO_VAR:\n  \"re:^/home/(\": AAA"))
+	if err == nil {
+		t.Errorf("expected an error for an invalid regular expression")
+	}
+}
+
+func TestResolvePathItemExclusion(t *testing.T) {
+	config, err := UnmarshalVarsConfig([]byte(strings.TrimSpace(`
+FOO_VAR:
+  /work/oss/special: special
+  /work: work
+  "!/work/oss":
+  /: root
+	`)))
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	pathItems := (*config)["FOO_VAR"]
+	cases := map[string]string{
+		"/work/app":           "work",
+		"/work/oss":           "root",
+		"/work/oss/lib":       "root",
+		"/work/oss/special/x": "special",
+		"/other":              "root",
+	}
+	for _, resolution := range []Resolution{ResolutionMostSpecific, ResolutionFirstListed} {
+		for dir, expected := range cases {
+			match, _ := resolvePathItem(pathItems, MatchContext{WorkingDirectory: dir}, resolution)
+			if match == nil || *match.PathItem.Value != expected {
+				t.Errorf("expected %s in %s with %s, but got: %v", expected, dir, resolution, match)
+			}
+		}
+	}
+	match, _ := resolvePathItem(pathItems[:3], MatchContext{WorkingDirectory: "/work/oss"}, ResolutionMostSpecific)
+	if match != nil {
+		t.Errorf("expected no match, but got: %v", match)
+	}
+}
+
+func TestResolvePathItemExclusionFallback(t *testing.T) {
+	config, err := UnmarshalVarsConfig([]byte(strings.TrimSpace(`
+FOO_VAR:
+  ~/work: work
+  "!~/work/oss":
+  ~: home
+	`)))
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	// 除外より後に書かれた広い規則は除外されず、除外されたディレクトリーの値になる
+	pathItems := (*config)["FOO_VAR"]
+	for _, resolution := range []Resolution{ResolutionMostSpecific, ResolutionFirstListed} {
+		excluded := make([]string, 0)
+		context := MatchContext{
+			WorkingDirectory: "/home/me/work/oss/lib",
+			HomeDir:          "/home/me",
+			Explain: func(pathItem *PathItem, message string) {
+				if strings.HasPrefix(message, "excluded") {
+					excluded = append(excluded, pathItem.Path)
+				}
+			},
+		}
+		match, err := resolvePathItem(pathItems, context, resolution)
+		if err != nil {
+			t.Fatalf("expected no error, but got: %v", err)
+		}
+		if match == nil || *match.PathItem.Value != "home" {
+			t.Errorf("expected home with %s, but got: %v", resolution, match)
+		}
+		if !slices.Equal(excluded, []string{"~/work"}) {
+			t.Errorf("unexpected excluded paths with %s: %v", resolution, excluded)
+		}
+	}
+}
+
+func TestUnmarshalVarsConfigExclusionWithValue(t *testing.T) {
+	_, err := UnmarshalVarsConfig([]byte("FOO_VAR:\n  \"!/work/oss\": AAA"))
+	if err == nil {
+		t.Errorf("expected an error for an exclusion with a value")
+	}
+}
+
+func TestMatchPathItemSymlink(t *testing.T) {
+	homeDir := t.TempDir()
+	realCode := filepath.Join(homeDir, "data", "code")
+	if err := os.MkdirAll(filepath.Join(realCode, "proj"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(realCode, filepath.Join(homeDir, "code")); err != nil {
+		t.Fatal(err)
+	}
+	realHomeDir, err := filepath.EvalSymlinks(homeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		key     string
+		context MatchContext
+	}{
+		// シンボリックリンク経由のキーを実際のパスで照合する
+		{"~/code/proj", MatchContext{
+			WorkingDirectory:     filepath.Join(homeDir, "data", "code", "proj"),
+			RealWorkingDirectory: filepath.Join(realHomeDir, "data", "code", "proj"),
+			HomeDir:              homeDir,
+		}},
+		// 実際のパスのキーをシンボリックリンク経由の作業ディレクトリーで照合する
+		{filepath.Join(realHomeDir, "data", "code", "proj"), MatchContext{
+			WorkingDirectory:     filepath.Join(homeDir, "code", "proj"),
+			RealWorkingDirectory: filepath.Join(realHomeDir, "data", "code", "proj"),
+			HomeDir:              homeDir,
+		}},
+		// 相対パスのキーはホームディレクトリーからのパス
+		{"code/proj", MatchContext{
+			WorkingDirectory:     filepath.Join(homeDir, "code", "proj", "src"),
+			RealWorkingDirectory: filepath.Join(realHomeDir, "data", "code", "proj", "src"),
+			HomeDir:              homeDir,
+		}},
+	}
+	for _, c := range cases {
+		if match, _ := matchPathItem(&PathItem{Path: c.key}, c.context); match == nil {
+			t.Errorf("expected %s to match in %s", c.key, c.context.WorkingDirectory)
+		}
+	}
+}
+
+func TestExpandPathKey(t *testing.T) {
+	context := MatchContext{
+		HomeDir: "/home/me",
+		Environment: map[string]string{
+			"XDG_DATA_HOME": "/home/me/.local/share",
+			"GOPATH":        "/opt/go",
+			"WEIRD":         "a*b",
+		},
+	}
+	cases := []struct {
+		key      string
+		glob     bool
+		expected string
+	}{
+		{"~/src", false, "/home/me/src"},
+		{"/src/~/foo", false, "/src/~/foo"},
+		{"$XDG_DATA_HOME/foo", false, "/home/me/.local/share/foo"},
+		{"${GOPATH}/src", false, "/opt/go/src"},
+		{"/cost/$$5", false, "/cost/$5"},
+		{"src/$WEIRD", false, "/home/me/src/a*b"},
+		{"src/$WEIRD/*", true, `/home/me/src/a\*b/*`},
+	}
+	for _, c := range cases {
+		actual, err := expandPathKey(c.key, context, c.glob)
+		if err != nil {
+			t.Errorf("expected no error for %s, but got: %v", c.key, err)
+		} else if actual != c.expected {
+			t.Errorf("expected %s for %s, but got: %s", c.expected, c.key, actual)
+		}
+	}
+	if _, err := expandPathKey("$UNDEFINED/foo", context, false); err == nil {
+		t.Errorf("expected an error for an undefined variable")
+	}
+}
+
+func TestResolvePathItemUnexpandablePath(t *testing.T) {
+	config, err := UnmarshalVarsConfig([]byte(strings.TrimSpace(`
+FOO_VAR:
+  $PROJ: proj
+  ~envar-no-such-user/src: other
+  /work: work
+	`)))
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	// 展開できないキーの規則は合致しないものとして扱い、ほかの規則で解決する
+	warned := make([]string, 0)
+	explained := make([]string, 0)
+	context := MatchContext{
+		WorkingDirectory: "/work/app",
+		HomeDir:          "/home/me",
+		Environment:      map[string]string{},
+		Warn: func(pathItem *PathItem, err error) {
+			warned = append(warned, pathItem.Path)
+		},
+		Explain: func(pathItem *PathItem, message string) {
+			explained = append(explained, pathItem.Path+": "+message)
+		},
+	}
+	match, err := resolvePathItem((*config)["FOO_VAR"], context, ResolutionMostSpecific)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	if match == nil || *match.PathItem.Value != "work" {
+		t.Errorf("expected work, but got: %v", match)
+	}
+	if !slices.Equal(warned, []string{"$PROJ", "~envar-no-such-user/src"}) {
+		t.Errorf("unexpected warned paths: %v", warned)
+	}
+	if len(explained) == 0 || !strings.HasPrefix(explained[0], "$PROJ: does not match, because cannot expand the path") {
+		t.Errorf("unexpected explanation: %v", explained)
+	}
+}
+
+func TestReadEnvironmentBeforeEnvar(t *testing.T) {
+	t.Setenv("ENVAR_TEST_GOPATH", "/set/by/envar")
+	t.Setenv("ENVAR_TEST_ADDED", "added by envar")
+	t.Setenv("ENVAR_TEST_OWN", "own")
+	original := "/home/me/go"
+	// envar が設定した変数は設定する前の値にし、envar が設定していない変数はそのまま使う
+	environment := readEnvironmentBeforeEnvar(Snapshot{"ENVAR_TEST_GOPATH": &original, "ENVAR_TEST_ADDED": nil})
+	if value := environment["ENVAR_TEST_GOPATH"]; value != original {
+		t.Errorf("expected the original value, but got: %s", value)
+	}
+	if value, ok := environment["ENVAR_TEST_ADDED"]; ok {
+		t.Errorf("expected unset, but got: %s", value)
+	}
+	if value := environment["ENVAR_TEST_OWN"]; value != "own" {
+		t.Errorf("expected own, but got: %s", value)
+	}
+}
+
+func TestNormalizeGitURL(t *testing.T) {
+	cases := map[string]string{
+		"git@github.com:acme/repo.git":            "github.com/acme/repo",
+		"https://github.com/acme/repo.git":        "github.com/acme/repo",
+		"https://user@github.com/acme/repo/":      "github.com/acme/repo",
+		"ssh://git@github.com:22/acme/repo.git":   "github.com/acme/repo",
+		"github.com:acme/repo":                    "github.com/acme/repo",
+		"/srv/git/repo.git":                       "/srv/git/repo",
+		"git@gitlab.example.com:group/sub/repo":   "gitlab.example.com/group/sub/repo",
+		"git+ssh://git@github.com/acme/repo.git/": "github.com/acme/repo",
+	}
+	for input, expected := range cases {
+		if actual := normalizeGitURL(input); actual != expected {
+			t.Errorf("expected %s for %s, but got: %s", expected, input, actual)
+		}
+	}
+}
+
+func TestFindGitRepository(t *testing.T) {
+	root := t.TempDir()
+	repo := filepath.Join(root, "repo")
+	if err := os.MkdirAll(filepath.Join(repo, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, ".git", "config"), []byte(`[core]
+	bare = false
+[remote "origin"]
+	url = git@github.com:acme/repo.git
+	fetch = +refs/heads/*:refs/remotes/origin/*
+[remote "upstream"]
+	url = https://github.com/upstream/repo
+[branch "main"]
+	remote = origin
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// リンクされたワークツリー
+	worktree := filepath.Join(root, "worktree")
+	worktreeGitDir := filepath.Join(repo, ".git", "worktrees", "worktree")
+	if err := os.MkdirAll(worktreeGitDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(worktreeGitDir, "commondir"), []byte("../..\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(worktree, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(worktree, ".git"), []byte("gitdir: "+worktreeGitDir+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ directory, root string }{{repo, repo}, {filepath.Join(worktree, "src"), worktree}} {
+		repository, err := findGitRepository(c.directory)
+		if err != nil {
+			t.Fatalf("expected no error, but got: %v", err)
+		}
+		if repository == nil || repository.Root != c.root {
+			t.Fatalf("unexpected repository: %v", repository)
+		}
+		if len(repository.Remotes) != 2 || repository.Remotes[0] != "github.com/acme/repo" || repository.Remotes[1] != "github.com/upstream/repo" {
+			t.Errorf("unexpected remotes: %v", repository.Remotes)
+		}
+		pathItem := &PathItem{Path: "git:github.com/acme/*"}
+		if match, _ := matchPathItem(pathItem, MatchContext{WorkingDirectory: c.directory, GitRepository: repository}); match == nil {
+			t.Errorf("expected %s to match in %s", pathItem.Path, c.directory)
+		}
+		pathItem = &PathItem{Path: "git:github.com/globex/*"}
+		if match, _ := matchPathItem(pathItem, MatchContext{WorkingDirectory: c.directory, GitRepository: repository}); match != nil {
+			t.Errorf("expected %s not to match in %s", pathItem.Path, c.directory)
+		}
+	}
+}
+
+func TestMatchPathItemMarker(t *testing.T) {
+	homeDir := t.TempDir()
+	project := filepath.Join(homeDir, "src", "project")
+	if err := os.MkdirAll(filepath.Join(project, "cmd", "tool"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(project, "go.mod"), []byte("module example.com/project\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// ホームディレクトリーより上のマーカーは探さない
+	if err := os.WriteFile(filepath.Join(homeDir, "..", ".terraform-version"), []byte("1.0.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := UnmarshalVarsConfig([]byte(strings.TrimSpace(`
+GOFLAGS:
+  marker:go.mod: -C=$root $$HOME
+TF_CLI_ARGS:
+  marker:.terraform-version: foo
+	`)))
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	context := MatchContext{WorkingDirectory: filepath.Join(project, "cmd", "tool"), HomeDir: homeDir}
+	pathItem := &(*config)["GOFLAGS"][0]
+	match, err := matchPathItem(pathItem, context)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	if match == nil {
+		t.Fatalf("expected a match")
+	}
+	if match.Specificity != countPathComponents(project) {
+		t.Errorf("unexpected specificity: %d", match.Specificity)
+	}
+	if value := match.Expand(*pathItem.Value); value != "-C="+project+" $HOME" {
+		t.Errorf("unexpected expanded value: %s", value)
+	}
+	if value := match.ExpandQuoted("$root/x", quotePosix); value != quotePosix(project)+"/x" {
+		t.Errorf("unexpected quoted value: %s", value)
+	}
+	if match, _ := matchPathItem(&(*config)["TF_CLI_ARGS"][0], context); match != nil {
+		t.Errorf("expected no match beyond the home directory, but got: %v", match)
+	}
+	if _, err := UnmarshalVarsConfig([]byte("FOO_VAR:\n  marker:../go.mod: AAA")); err == nil {
+		t.Errorf("expected an error for a marker outside the directory")
+	}
+}
+
+func TestUnmarshalVarsConfigRuleMapping(t *testing.T) {
+	config, err := UnmarshalVarsConfig([]byte(strings.TrimSpace(`
+DOCKER_HOST:
+  ~:
+    - value: unix:///run/docker.sock
+      when:
+        host: laptop-*
+        os: [ linux, darwin ]
+    - exec:
+        echo: [ ci, runner ]
+      when:
+        user: ci
+    - tcp://localhost:2375
+	`)))
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	dockerHost := (*config)["DOCKER_HOST"]
+	if len(dockerHost) != 3 {
+		t.Fatalf("expected DOCKER_HOST to have 3 entries, but got: %v", dockerHost)
+	}
+	if dockerHost[0].Path != "~" || *dockerHost[0].Value != "unix:///run/docker.sock" {
+		t.Errorf("unexpected first entry: %v", dockerHost[0])
+	}
+	condition := dockerHost[0].Condition
+	if condition == nil || len(condition.Hosts) != 1 || len(condition.OSes) != 2 || condition.Users != nil {
+		t.Errorf("unexpected condition: %v", condition)
+	}
+	if dockerHost[1].Exec == nil || dockerHost[1].Exec.Id != "echo" || len(dockerHost[1].Exec.Args) != 2 {
+		t.Errorf("unexpected exec: %v", dockerHost[1].Exec)
+	}
+	if dockerHost[2].Condition != nil || *dockerHost[2].Value != "tcp://localhost:2375" {
+		t.Errorf("unexpected last entry: %v", dockerHost[2])
+	}
+	for _, machine := range []struct {
+		machine  Machine
+		expected string
+	}{
+		{Machine{Host: "laptop-1", User: "me", OS: "linux"}, "unix:///run/docker.sock"},
+		{Machine{Host: "laptop-1", User: "me", OS: "windows"}, "tcp://localhost:2375"},
+		{Machine{Host: "server", User: "me", OS: "linux"}, "tcp://localhost:2375"},
+	} {
+		match, _ := resolvePathItem(dockerHost, MatchContext{WorkingDirectory: "/home/me", HomeDir: "/home/me", Machine: machine.machine}, ResolutionMostSpecific)
+		if match == nil || match.PathItem.Value == nil || *match.PathItem.Value != machine.expected {
+			t.Errorf("expected %s on %v, but got: %v", machine.expected, machine.machine, match)
+		}
+	}
+	match, _ := resolvePathItem(dockerHost, MatchContext{WorkingDirectory: "/home/me", HomeDir: "/home/me", Machine: Machine{User: "ci"}}, ResolutionMostSpecific)
+	if match == nil || match.PathItem.Exec == nil {
+		t.Errorf("expected the exec entry for ci, but got: %v", match)
+	}
+}
+
+func TestUnmarshalVarsConfigInvalidCondition(t *testing.T) {
+	for _, config := range []string{
+		"FOO_VAR:\n  /a:\n    value: A\n    when:\n      planet: earth",
+		"FOO_VAR:\n  /a:\n    value: A\n    when:\n      host: \"[a-\"",
+		"FOO_VAR:\n  /a:\n    value: A\n    exec:\n      echo: a",
+		"FOO_VAR:\n  \"!/a\":\n    value: A",
+	} {
+		if _, err := UnmarshalVarsConfig([]byte(config)); err == nil {
+			t.Errorf("expected an error for %q", config)
+		}
+	}
+}
+
+func TestResolvePathItemEnvCondition(t *testing.T) {
+	config, err := UnmarshalVarsConfig([]byte(strings.TrimSpace(`
+KUBECONFIG:
+  /ops:
+    - value: /ops/prod.yaml
+      when:
+        env:
+          ENVAR_PROFILE: prod
+    - value: /ops/dev.yaml
+      when:
+        env:
+          CI:
+	`)))
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	pathItems := (*config)["KUBECONFIG"]
+	cases := []struct {
+		environment map[string]string
+		expected    string
+		explained   string
+	}{
+		{map[string]string{"ENVAR_PROFILE": "prod", "CI": "true"}, "/ops/prod.yaml", ""},
+		{map[string]string{"ENVAR_PROFILE": "dev"}, "/ops/dev.yaml", "skipped, because env 'ENVAR_PROFILE' does not match [prod]"},
+		{map[string]string{"CI": "true"}, "", "skipped, because env 'CI' is set"},
+	}
+	for _, c := range cases {
+		messages := make([]string, 0)
+		context := MatchContext{
+			WorkingDirectory: "/ops/cluster",
+			Environment:      c.environment,
+			Explain: func(pathItem *PathItem, message string) {
+				messages = append(messages, message)
+			},
+		}
+		match, err := resolvePathItem(pathItems, context, ResolutionMostSpecific)
+		if err != nil {
+			t.Fatalf("expected no error, but got: %v", err)
+		}
+		if c.expected == "" {
+			if match != nil {
+				t.Errorf("expected no match with %v, but got: %v", c.environment, match)
+			}
+		} else if match == nil || *match.PathItem.Value != c.expected {
+			t.Errorf("expected %s with %v, but got: %v", c.expected, c.environment, match)
+		}
+		if c.explained != "" && !slices.Contains(messages, c.explained) {
+			t.Errorf("expected explanation %q with %v, but got: %v", c.explained, c.environment, messages)
+		}
+	}
+}
+
+func TestResolvePathItemProfileCondition(t *testing.T) {
+	config, err := UnmarshalVarsConfig([]byte(strings.TrimSpace(`
+GIT_AUTHOR_EMAIL:
+  ~:
+    - value: me@work.example.com
+      when:
+        profile: work
+    - value: me@example.com
+	`)))
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	pathItems := (*config)["GIT_AUTHOR_EMAIL"]
+	for profile, expected := range map[string]string{"work": "me@work.example.com", "personal": "me@example.com", "": "me@example.com"} {
+		context := MatchContext{WorkingDirectory: "/home/me/src", HomeDir: "/home/me", Profile: profile}
+		match, _ := resolvePathItem(pathItems, context, ResolutionMostSpecific)
+		if match == nil || *match.PathItem.Value != expected {
+			t.Errorf("expected %s with profile %q, but got: %v", expected, profile, match)
+		}
+	}
+}
+
+func TestTakeSnapshot(t *testing.T) {
+	t.Setenv("ENVAR_TEST_SET", "original")
+	os.Unsetenv("ENVAR_TEST_UNSET")
+	snapshot := make(Snapshot)
+	takeSnapshot(snapshot, "ENVAR_TEST_SET")
+	takeSnapshot(snapshot, "ENVAR_TEST_UNSET")
+	if value, ok := snapshot["ENVAR_TEST_SET"]; !ok || value == nil || *value != "original" {
+		t.Errorf("unexpected snapshot of a set variable: %v", value)
+	}
+	if value, ok := snapshot["ENVAR_TEST_UNSET"]; !ok || value != nil {
+		t.Errorf("unexpected snapshot of an unset variable: %v", value)
+	}
+	// 既に記録されていれば上書きしない
+	t.Setenv("ENVAR_TEST_SET", "changed by envar")
+	takeSnapshot(snapshot, "ENVAR_TEST_SET")
+	if value := snapshot["ENVAR_TEST_SET"]; *value != "original" {
+		t.Errorf("expected the snapshot not to be overwritten, but got: %s", *value)
+	}
+}
+
+func TestRestoreRemovedVars(t *testing.T) {
+	original := "original"
+	snapshot := Snapshot{"KEPT": nil, "REMOVED_SET": &original, "REMOVED_UNSET": nil}
+	assignments := restoreRemovedVars(snapshot, &VarsConfig{"KEPT": []PathItem{}})
+	if len(assignments) != 2 {
+		t.Fatalf("expected 2 assignments, but got: %v", assignments)
+	}
+	for _, assignment := range assignments {
+		switch assignment.Name {
+		case "REMOVED_SET":
+			if assignment.Value == nil || *assignment.Value != "original" {
+				t.Errorf("unexpected value for REMOVED_SET: %v", assignment.Value)
+			}
+		case "REMOVED_UNSET":
+			if assignment.Value != nil {
+				t.Errorf("unexpected value for REMOVED_UNSET: %v", *assignment.Value)
+			}
+		default:
+			t.Errorf("unexpected assignment: %v", assignment)
+		}
+	}
+	if _, ok := snapshot["KEPT"]; !ok || len(snapshot) != 1 {
+		t.Errorf("unexpected snapshot: %v", snapshot)
+	}
+}
+
+func TestFingerprintAssignment(t *testing.T) {
+	secret := "ghp_secret"
+	other := "ghp_other"
+	key := []byte("key")
+	fingerprint := fingerprintAssignment(key, Assignment{Name: "GH_TOKEN", Value: &secret})
+	if strings.Contains(fingerprint, secret) {
+		t.Errorf("fingerprint must not contain the value: %s", fingerprint)
+	}
+	if !strings.HasPrefix(fingerprint, "GH_TOKEN=") {
+		t.Errorf("fingerprint must start with the name: %s", fingerprint)
+	}
+	if fingerprint != fingerprintAssignment(key, Assignment{Name: "GH_TOKEN", Value: &secret}) {
+		t.Error("fingerprint must be stable")
+	}
+	if fingerprint == fingerprintAssignment(key, Assignment{Name: "GH_TOKEN", Value: &other}) {
+		t.Error("fingerprint must change with the value")
+	}
+	if fingerprint == fingerprintAssignment([]byte("another key"), Assignment{Name: "GH_TOKEN", Value: &secret}) {
+		t.Error("fingerprint must change with the key")
+	}
+	if fingerprintAssignment(key, Assignment{Name: "GH_TOKEN"}) != "GH_TOKEN" {
+		t.Error("fingerprint of an unset variable must be its name")
+	}
+}
+
+func TestWriteSessionFile(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	writeCache("1", &Cache{State: "state", Fingerprints: []string{"FOO=abc", "BAR"}})
+	if cache := readCache("1"); cache.State != "state" || !slices.Equal(cache.Fingerprints, []string{"FOO=abc", "BAR"}) {
+		t.Errorf("unexpected cache: %v", cache)
+	}
+	dirInfo, err := os.Stat(makeSessionDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileInfo, err := os.Stat(makeCachePath("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" {
+		if mode := dirInfo.Mode().Perm(); mode != 0700 {
+			t.Errorf("unexpected mode of the directory: %o", mode)
+		}
+		if mode := fileInfo.Mode().Perm(); mode != 0600 {
+			t.Errorf("unexpected mode of the file: %o", mode)
+		}
+	}
+}
+
+func TestLockSession(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	const goroutines = 16
+	const iterations = 20
+	var wait sync.WaitGroup
+	for i := range goroutines {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for j := range iterations {
+				unlock := lockSession("1")
+				cache := readCache("1")
+				cache.Fingerprints = append(cache.Fingerprints, fmt.Sprintf("%d-%d", i, j))
+				writeCache("1", cache)
+				unlock()
+			}
+		}()
+	}
+	wait.Wait()
+	if lines := readCache("1").Fingerprints; len(lines) != goroutines*iterations {
+		t.Errorf("expected %d lines, but got: %d", goroutines*iterations, len(lines))
+	}
+}
+
+func TestWriteSessionFileAtomically(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	path := makeCachePath("1")
+	contents := [][]byte{
+		[]byte(strings.Repeat("a", 1<<16)),
+		[]byte(strings.Repeat("b", 1<<16)),
+	}
+	var wait sync.WaitGroup
+	for i := range 8 {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for range 50 {
+				if err := writeSessionFile(path, contents[i%2]); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for range 4 {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for range 200 {
+				bytes, err := readSessionFile(path)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if bytes != nil && !slices.ContainsFunc(contents, func(content []byte) bool { return string(content) == string(bytes) }) {
+					t.Errorf("read a partially written file of %d bytes", len(bytes))
+					return
+				}
+			}
+		}()
+	}
+	wait.Wait()
+	entries, err := os.ReadDir(makeSessionDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			t.Errorf("temporary file is left: %s", entry.Name())
+		}
+	}
+}
+
+func TestParseSessionFileName(t *testing.T) {
+	token := strings.Repeat("0123456789abcdef", 2)
+	testCases := []struct {
+		name    string
+		session SessionId
+		ok      bool
+	}{
+		{"cache.123", "123", true},
+		{"snapshot.123.json", "123", true},
+		{"cache.123.456789.tmp", "123", true},
+		{"script.123.bash", "123", true},
+		{"shell." + token + ".json", token, true},
+		{"key", "", false},
+		{"key.lock", "", false},
+		{"cache.abc", "", false},
+		{"other.123", "", false},
+	}
+	for _, testCase := range testCases {
+		session, ok := parseSessionFileName(testCase.name)
+		if session != testCase.session || ok != testCase.ok {
+			t.Errorf("%s: expected %s, %v, but got: %s, %v", testCase.name, testCase.session, testCase.ok, session, ok)
+		}
+	}
+}
+
+func TestIsValidSessionId(t *testing.T) {
+	testCases := []struct {
+		session string
+		valid   bool
+	}{
+		{"123", true},
+		{strings.Repeat("0123456789abcdef", 2), true},
+		{strings.Repeat("0123456789ABCDEF", 2), false},
+		{"0123456789abcdef", false},
+		{"../key", false},
+		{"", false},
+		{"-1", false},
+	}
+	for _, testCase := range testCases {
+		if valid := isValidSessionId(testCase.session); valid != testCase.valid {
+			t.Errorf("%s: expected %v, but got: %v", testCase.session, testCase.valid, valid)
+		}
+	}
+}
+
+func TestNewSession(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	session := newSession(uint(os.Getpid()))
+	if !isValidSessionId(session) {
+		t.Errorf("invalid session: %s", session)
+	}
+	if session == newSession(uint(os.Getpid())) {
+		t.Error("sessions must be different")
+	}
+	record := readShellRecord(session)
+	if record == nil || record.Pid != uint(os.Getpid()) || record.Namespace != readPidNamespace() {
+		t.Errorf("unexpected shell record: %v", record)
+	}
+}
+
+func TestReadProcessStartTime(t *testing.T) {
+	startTime, err := readProcessStartTime(uint(os.Getpid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := readProcessStartTime(uint(os.Getpid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if startTime != again {
+		t.Errorf("start time must be stable: %s, %s", startTime, again)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	// 以前の版のキャッシュの置き場所も一時ディレクトリーにする
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LocalAppData", t.TempDir())
+	deadPid := uint(4000000)
+	for {
+		_, err := readProcessStartTime(deadPid)
+		if err == errProcessNotFound {
+			break
+		}
+		deadPid++
+	}
+	alive, err := makeShellRecord(uint(os.Getpid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := &ShellRecord{Pid: deadPid, Namespace: alive.Namespace, StartTime: alive.StartTime}
+	otherNamespace := &ShellRecord{Pid: deadPid, Namespace: "other", StartTime: alive.StartTime}
+	deadSession := SessionId(strconv.FormatUint(uint64(deadPid), 10))
+	aliveSession := strings.Repeat("a", sessionTokenLength)
+	deadTokenSession := strings.Repeat("b", sessionTokenLength)
+	otherNamespaceSession := strings.Repeat("c", sessionTokenLength)
+	noRecordSession := strings.Repeat("d", sessionTokenLength)
+	records := map[SessionId]*ShellRecord{
+		deadSession:           dead,
+		aliveSession:          alive,
+		deadTokenSession:      dead,
+		otherNamespaceSession: otherNamespace,
+	}
+	for session, record := range records {
+		writeShellRecord(session, record)
+	}
+	for _, session := range []SessionId{deadSession, aliveSession, deadTokenSession, otherNamespaceSession, noRecordSession} {
+		writeCache(session, &Cache{Fingerprints: []string{"FOO"}})
+	}
+	legacyPath := makeLegacyCachedScriptPath(deadSession)
+	if err := os.MkdirAll(filepath.Dir(legacyPath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(legacyPath, []byte("export FOO='foo'"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := collectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{makeCachePath(deadSession), makeShellRecordPath(deadSession), legacyPath, makeCachePath(deadTokenSession)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected to be removed: %s", path)
+		}
+	}
+	for _, session := range []SessionId{aliveSession, otherNamespaceSession, noRecordSession} {
+		if _, err := os.Stat(makeCachePath(session)); err != nil {
+			t.Errorf("expected to be kept: %v", err)
+		}
+	}
+	// PID が再利用されたら前のシェルのファイルを消す
+	writeShellRecord(aliveSession, &ShellRecord{Pid: alive.Pid, Namespace: alive.Namespace, StartTime: "reused"})
+	if err := collectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(makeCachePath(aliveSession)); !os.IsNotExist(err) {
+		t.Error("expected the cache of the reused PID to be removed")
+	}
+}
+
+func TestMakeState(t *testing.T) {
+	varsConfig, err := UnmarshalVarsConfig([]byte("FOO:\n  /:\n    value: foo\n    when:\n      env:\n        STAGE: prod\nBAR:\n  marker:go.mod: bar\nBAZ:\n  $PROJ/src: baz\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs := &Configs{Vars: varsConfig}
+	workingDirectory := t.TempDir()
+	context := MatchContext{
+		WorkingDirectory:     workingDirectory,
+		RealWorkingDirectory: workingDirectory,
+		HomeDir:              filepath.Dir(workingDirectory),
+		Environment:          map[string]string{"STAGE": "prod", "PROJ": "/p", "OTHER": "a"},
+		GitRepository:        &GitRepository{Root: workingDirectory, Remotes: []string{"github.com/acme/api"}},
+	}
+	key := []byte("key")
+	stateOf := func(configs *Configs, context MatchContext) string {
+		state, err := makeState(key, configs, context)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state
+	}
+	state := stateOf(configs, context)
+	if state != stateOf(configs, context) {
+		t.Error("state must be stable")
+	}
+	// 条件やパスで参照しない環境変数は状態に含めない
+	context.Environment = map[string]string{"STAGE": "prod", "PROJ": "/p", "OTHER": "b"}
+	if state != stateOf(configs, context) {
+		t.Error("state must not depend on unreferenced variables")
+	}
+	changes := map[string]func(*Configs, *MatchContext){
+		"working directory": func(_ *Configs, context *MatchContext) { context.WorkingDirectory = "/other" },
+		"profile":           func(_ *Configs, context *MatchContext) { context.Profile = "work" },
+		"config":            func(configs *Configs, _ *MatchContext) { configs.Digest[0] = 1 },
+		"env value":         func(_ *Configs, context *MatchContext) { context.Environment = map[string]string{"STAGE": "dev"} },
+		"unset env":         func(_ *Configs, context *MatchContext) { context.Environment = map[string]string{} },
+		"path env value": func(_ *Configs, context *MatchContext) {
+			context.Environment = map[string]string{"STAGE": "prod", "PROJ": "/q"}
+		},
+		"unset path env": func(_ *Configs, context *MatchContext) { context.Environment = map[string]string{"STAGE": "prod"} },
+		"git remote": func(_ *Configs, context *MatchContext) {
+			context.GitRepository = &GitRepository{Root: workingDirectory, Remotes: []string{"github.com/acme/web"}}
+		},
+		"git repository": func(_ *Configs, context *MatchContext) { context.GitRepository = nil },
+		"marker": func(_ *Configs, _ *MatchContext) {
+			if err := os.WriteFile(filepath.Join(workingDirectory, "go.mod"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+	for name, change := range changes {
+		changedConfigs := *configs
+		changedContext := context
+		change(&changedConfigs, &changedContext)
+		if state == stateOf(&changedConfigs, changedContext) {
+			t.Errorf("state must change with the %s", name)
+		}
+		if err := os.RemoveAll(filepath.Join(workingDirectory, "go.mod")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRunCachedExecCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands are run with sh")
+	}
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	countPath := filepath.Join(t.TempDir(), "count")
+	execConfig := ExecConfig{Command: "echo %s >> " + countPath + "; wc -l < " + countPath, TTL: time.Hour}
+	key := []byte("key")
+	run := func(execConfig ExecConfig, arg string) string {
+		value, err := runCachedExecCommand(key, "count", execConfig, []string{arg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(value)
+	}
+	if value := run(execConfig, "a"); value != "1" {
+		t.Errorf("unexpected first value: %s", value)
+	}
+	if value := run(execConfig, "a"); value != "1" {
+		t.Errorf("expected the cached value, but got: %s", value)
+	}
+	// 引数が違えば別の結果
+	if value := run(execConfig, "b"); value != "2" {
+		t.Errorf("expected to run for another argument, but got: %s", value)
+	}
+	// 値はファイルに平文で残さない
+	entries, err := os.ReadDir(makeSessionDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		bytes, err := os.ReadFile(filepath.Join(makeSessionDir(), entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(bytes), countPath) || strings.Contains(string(bytes), "\"value\"") {
+			t.Errorf("exec cache must be encrypted: %s", entry.Name())
+		}
+	}
+	if value := run(ExecConfig{Command: execConfig.Command}, "a"); value != "3" {
+		t.Errorf("expected not to be cached without ttl, but got: %s", value)
+	}
+	path := makeExecCachePath(key, "count", execConfig, []string{"a"})
+	if err := writeExecCache(key, path, &ExecCacheEntry{Value: "1", ExpiresAt: time.Now().Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if expired, err := isExecCacheExpired(key, path); err != nil || !expired {
+		t.Errorf("expected to be expired: %v", err)
+	}
+	if value := run(execConfig, "a"); value != "4" {
+		t.Errorf("expected to run after expiration, but got: %s", value)
+	}
+	if err := clearExecCache(); err != nil {
+		t.Fatal(err)
+	}
+	if value := run(execConfig, "a"); value != "5" {
+		t.Errorf("expected to run after clearing, but got: %s", value)
+	}
+}
+
+func TestWriteSnapshot(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	secret := "ghp_secret"
+	key := []byte("key")
+	writeSnapshot("1", key, Snapshot{"GH_TOKEN": &secret, "UNSET": nil})
+	bytes, err := os.ReadFile(makeSnapshotPath("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(bytes), secret) || strings.Contains(string(bytes), "GH_TOKEN") {
+		t.Error("snapshot must be encrypted")
+	}
+	snapshot := readSnapshot("1", key)
+	if value := snapshot["GH_TOKEN"]; value == nil || *value != secret {
+		t.Errorf("unexpected value: %v", value)
+	}
+	if value, ok := snapshot["UNSET"]; !ok || value != nil {
+		t.Errorf("unexpected value of an unset variable: %v", value)
+	}
+	// 以前の版の平文の記録も読める
+	if err := writeSessionFile(makeSnapshotPath("1"), []byte(`{"FOO":"foo"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if value := readSnapshot("1", key)["FOO"]; value == nil || *value != "foo" {
+		t.Errorf("unexpected value of a plaintext snapshot: %v", value)
+	}
+	// 別の鍵で暗号化された記録は空として扱う
+	writeSnapshot("1", []byte("old key"), Snapshot{"GH_TOKEN": &secret})
+	if snapshot := readSnapshot("1", key); len(snapshot) != 0 {
+		t.Errorf("expected an empty snapshot, but got: %v", snapshot)
+	}
+}
+
+func TestWriteCacheRemovesLegacyCache(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LocalAppData", t.TempDir())
+	legacyPath := makeLegacyCachedScriptPath("1")
+	if err := os.MkdirAll(filepath.Dir(legacyPath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(legacyPath, []byte("export GH_TOKEN='ghp_secret'"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeCache("1", &Cache{})
+	if _, err := os.Stat(legacyPath); !os.IsNotExist(err) {
+		t.Error("expected the legacy cache to be removed")
+	}
+}
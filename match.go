@@ -0,0 +1,514 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// isPathUnder は dir が base 自身かその子孫であるかをパスの要素単位で判定する
+func isPathUnder(dir string, base string) bool {
+	dir = filepath.Clean(dir)
+	base = filepath.Clean(base)
+	if dir == base {
+		return true
+	}
+	prefix := base
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+	return strings.HasPrefix(dir, prefix)
+}
+
+// MatchContext は規則の照合に使う現在の状態
+type MatchContext struct {
+	// 論理的なパス（$PWD）
+	WorkingDirectory string
+	// シンボリックリンクを解決したパス。空なら WorkingDirectory のみを使う
+	RealWorkingDirectory string
+	HomeDir              string
+	// パスのキーの $VAR の展開と条件に使う環境変数。envar が設定した変数は設定する前の値
+	Environment map[string]string
+	// 作業ディレクトリーを含む git のワークツリー。なければ nil
+	GitRepository *GitRepository
+	Machine       Machine
+	// シェルで有効なプロファイル。なければ空文字列
+	Profile string
+	// nil でなければ各規則を選ばなかった、あるいは選んだ理由を受け取る
+	Explain func(pathItem *PathItem, message string)
+	// nil でなければ合致するかを判定できなかった規則とそのエラーを受け取る
+	Warn func(pathItem *PathItem, err error)
+}
+
+func (context MatchContext) explain(pathItem *PathItem, format string, args ...any) {
+	if context.Explain != nil {
+		context.Explain(pathItem, fmt.Sprintf(format, args...))
+	}
+}
+
+func (context MatchContext) warn(pathItem *PathItem, err error) {
+	if context.Warn != nil {
+		context.Warn(pathItem, err)
+	}
+}
+
+func (context MatchContext) workingDirectories() []string {
+	if context.RealWorkingDirectory == "" || context.RealWorkingDirectory == context.WorkingDirectory {
+		return []string{context.WorkingDirectory}
+	}
+	return []string{context.WorkingDirectory, context.RealWorkingDirectory}
+}
+
+// Match は合致した規則とその具体性（パスの要素数）
+type Match struct {
+	PathItem    *PathItem
+	Specificity int
+	// 正規表現の規則でキャプチャーを展開するために使う
+	subject    string
+	submatches []int
+	// マーカーの規則で見つかったプロジェクトのルート
+	projectRoot string
+}
+
+// Expand は正規表現の規則のとき template 中の $1 や ${name} をキャプチャーで置き換える
+// マーカーの規則のときは $root と ${root} をプロジェクトのルートで置き換える
+func (match *Match) Expand(template string) string {
+	return match.ExpandQuoted(template, func(value string) string { return value })
+}
+
+// ExpandQuoted は Expand と同じように置き換えるが、置き換える値を quote で囲む
+// ディレクトリー名はリポジトリーなどから持ち込まれうるので、コマンドに埋め込むときはシェル向けに囲む
+func (match *Match) ExpandQuoted(template string, quote func(string) string) string {
+	switch {
+	case match.PathItem.Regexp != nil:
+		// 囲んだキャプチャーを並べた文字列とその位置を作り、ExpandString の書式の解釈はそのまま使う
+		var subject strings.Builder
+		submatches := make([]int, len(match.submatches))
+		for i := 0; i < len(match.submatches); i += 2 {
+			start, end := match.submatches[i], match.submatches[i+1]
+			if start < 0 {
+				submatches[i], submatches[i+1] = -1, -1
+				continue
+			}
+			submatches[i] = subject.Len()
+			subject.WriteString(quote(match.subject[start:end]))
+			submatches[i+1] = subject.Len()
+		}
+		return string(match.PathItem.Regexp.ExpandString(nil, template, subject.String(), submatches))
+	case match.projectRoot != "":
+		return os.Expand(template, func(name string) string {
+			switch name {
+			case "root":
+				return quote(match.projectRoot)
+			case "$":
+				return "$"
+			default:
+				return "$" + name
+			}
+		})
+	default:
+		return template
+	}
+}
+
+// resolvePathItem は合致した規則のうち resolution に従って 1 つを選ぶ。合致しなければ nil
+func resolvePathItem(pathItems []PathItem, context MatchContext, resolution Resolution) (*Match, error) {
+	candidates := make([]*Match, 0)
+	for i := range pathItems {
+		pathItem := &pathItems[i]
+		if condition := pathItem.Condition; condition != nil {
+			if err := condition.Check(context); err != nil {
+				context.explain(pathItem, "skipped, because %v", err)
+				continue
+			}
+		}
+		match, err := matchPathItem(pathItem, context)
+		if errors.Is(err, errCannotExpandPathKey) {
+			// 別のマシン向けのキーで全体が止まらないよう、展開できないキーの規則は合致しないものとして扱う
+			context.warn(pathItem, err)
+			context.explain(pathItem, "does not match, because %v", err)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to match path '%s', because %w", pathItem.Path, err)
+		}
+		if match == nil {
+			context.explain(pathItem, "does not match")
+			continue
+		}
+		if match.PathItem.Exclude {
+			// 除外より前に書かれた、除外と同じかより広い規則を候補から外す
+			candidates = slices.DeleteFunc(candidates, func(candidate *Match) bool {
+				excluded := candidate.Specificity <= match.Specificity
+				if excluded {
+					context.explain(candidate.PathItem, "excluded by %s%s", excludePathPrefix, pathItem.Path)
+				}
+				return excluded
+			})
+			context.explain(pathItem, "matches with specificity %d", match.Specificity)
+			continue
+		}
+		context.explain(pathItem, "matches with specificity %d", match.Specificity)
+		candidates = append(candidates, match)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	if resolution == ResolutionFirstListed {
+		return candidates[0], nil
+	}
+	selected := candidates[0]
+	for _, candidate := range candidates[1:] {
+		// 同じ深さなら先に書かれたほうを優先する
+		if selected.Specificity < candidate.Specificity {
+			selected = candidate
+		}
+	}
+	return selected, nil
+}
+
+// matchPathItem は規則が合致すればその情報を、合致しなければ nil を返す
+// 論理的な作業ディレクトリーを優先し、合致しなければ実際のパスで照合する
+func matchPathItem(pathItem *PathItem, context MatchContext) (*Match, error) {
+	for _, directory := range context.workingDirectories() {
+		match, err := matchPathItemIn(pathItem, context, directory)
+		if err != nil || match != nil {
+			return match, err
+		}
+	}
+	return nil, nil
+}
+
+func matchPathItemIn(pathItem *PathItem, context MatchContext, directory string) (*Match, error) {
+	if pattern, ok := strings.CutPrefix(pathItem.Path, gitPathPrefix); ok {
+		return matchGitRemote(pathItem, pattern, context.GitRepository), nil
+	}
+	if marker, ok := strings.CutPrefix(pathItem.Path, markerPathPrefix); ok {
+		projectRoot, err := findMarker(directory, marker, context.HomeDir)
+		if err != nil || projectRoot == "" {
+			return nil, err
+		}
+		return &Match{PathItem: pathItem, Specificity: countPathComponents(projectRoot), projectRoot: projectRoot}, nil
+	}
+	if pathItem.Regexp != nil {
+		subject := filepath.ToSlash(directory)
+		submatches := pathItem.Regexp.FindStringSubmatchIndex(subject)
+		if submatches == nil {
+			return nil, nil
+		}
+		return &Match{
+			PathItem:    pathItem,
+			Specificity: countPathComponents(subject[:submatches[1]]),
+			subject:     subject,
+			submatches:  submatches,
+		}, nil
+	}
+	if !isGlobPattern(pathItem.Path) {
+		p, err := expandPathKey(pathItem.Path, context, false)
+		if err != nil {
+			return nil, fmt.Errorf("%w, because %w", errCannotExpandPathKey, err)
+		}
+		if isPathUnder(directory, p) {
+			return &Match{PathItem: pathItem, Specificity: countPathComponents(p)}, nil
+		}
+		// キーがシンボリックリンクを含む場合は解決したパスでも照合する
+		if real, err := filepath.EvalSymlinks(p); err == nil && real != p && isPathUnder(directory, real) {
+			return &Match{PathItem: pathItem, Specificity: countPathComponents(p)}, nil
+		}
+		return nil, nil
+	}
+	pattern, err := expandPathKey(pathItem.Path, context, true)
+	if err != nil {
+		return nil, fmt.Errorf("%w, because %w", errCannotExpandPathKey, err)
+	}
+	// パターンは UnmarshalVarsConfig で検証済み
+	alternatives, _ := expandBraces(filepath.ToSlash(pattern))
+	directoryComponents := splitPath(directory)
+	for _, alternative := range alternatives {
+		patternComponents := splitPath(alternative)
+		if matchGlobComponents(patternComponents, directoryComponents) {
+			specificity := 0
+			for _, component := range patternComponents {
+				if component != "" && component != "**" {
+					specificity++
+				}
+			}
+			return &Match{PathItem: pathItem, Specificity: specificity}, nil
+		}
+	}
+	return nil, nil
+}
+
+// matchGitRemote はいずれかのリモートがパターンに合致するかを判定する
+// 具体性はワークツリーのルートの要素数とする
+func matchGitRemote(pathItem *PathItem, pattern string, repository *GitRepository) *Match {
+	if repository == nil {
+		return nil
+	}
+	// パターンは UnmarshalVarsConfig で検証済み
+	alternatives, _ := expandBraces(pattern)
+	for _, remote := range repository.Remotes {
+		for _, alternative := range alternatives {
+			if matchGlobComponents(strings.Split(alternative, "/"), strings.Split(remote, "/")) {
+				return &Match{PathItem: pathItem, Specificity: countPathComponents(repository.Root)}
+			}
+		}
+	}
+	return nil
+}
+
+// markerNames は marker: の規則で探すマーカーを重複なしで順に返す
+func markerNames(varsConfig *VarsConfig) []string {
+	markers := make([]string, 0)
+	for _, pathItems := range *varsConfig {
+		for _, pathItem := range pathItems {
+			if marker, ok := strings.CutPrefix(pathItem.Path, markerPathPrefix); ok {
+				markers = append(markers, marker)
+			}
+		}
+	}
+	slices.Sort(markers)
+	return slices.Compact(markers)
+}
+
+// pathKeyEnvNames はパスのキーで参照する環境変数の名前を重複なしで順に返す
+func pathKeyEnvNames(varsConfig *VarsConfig) []string {
+	names := make([]string, 0)
+	for _, pathItems := range *varsConfig {
+		for _, pathItem := range pathItems {
+			// 正規表現、git: と marker: のキーは展開しない
+			if pathItem.Regexp != nil || strings.HasPrefix(pathItem.Path, gitPathPrefix) || strings.HasPrefix(pathItem.Path, markerPathPrefix) {
+				continue
+			}
+			os.Expand(pathItem.Path, func(name string) string {
+				if name != "$" {
+					names = append(names, name)
+				}
+				return ""
+			})
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// findMarker は directory から親へ marker を含むディレクトリーを探す
+// ホームディレクトリーの配下ならホームディレクトリーで、そうでなければルートで探すのをやめる。見つからなければ空文字列
+func findMarker(directory string, marker string, homeDir string) (string, error) {
+	directory = filepath.Clean(directory)
+	stopAtHome := homeDir != "" && isPathUnder(directory, homeDir)
+	for {
+		markerPath := filepath.Join(directory, marker)
+		_, err := os.Stat(markerPath)
+		if err == nil {
+			return directory, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to stat: %s, because %w", markerPath, err)
+		}
+		parent := filepath.Dir(directory)
+		if parent == directory || (stopAtHome && directory == filepath.Clean(homeDir)) {
+			return "", nil
+		}
+		directory = parent
+	}
+}
+
+var errCannotExpandPathKey = errors.New("cannot expand the path")
+
+// expandPathKey は先頭の ~ と ~user、$VAR と ${VAR} を展開し、相対パスをホームディレクトリーからのパスにする
+// glob が真のときは展開した部分をグロブとしてエスケープする
+func expandPathKey(key string, context MatchContext, glob bool) (string, error) {
+	escape := func(s string) string {
+		if glob {
+			return escapeGlob(s)
+		}
+		return s
+	}
+	if rest, ok := strings.CutPrefix(key, "~"); ok {
+		userName := rest
+		rest = ""
+		if i := strings.IndexAny(userName, `/`+string(filepath.Separator)); 0 <= i {
+			userName, rest = userName[:i], userName[i:]
+		}
+		homeDir := context.HomeDir
+		if userName != "" {
+			u, err := user.Lookup(userName)
+			if err != nil {
+				return "", fmt.Errorf("failed to look up user '%s', because %w", userName, err)
+			}
+			homeDir = u.HomeDir
+		}
+		key = escape(homeDir) + rest
+	}
+	var undefined []string
+	key = os.Expand(key, func(name string) string {
+		// $$ は $ そのもの
+		if name == "$" {
+			return "$"
+		}
+		value, ok := context.Environment[name]
+		if !ok {
+			undefined = append(undefined, name)
+		}
+		return escape(value)
+	})
+	if len(undefined) != 0 {
+		return "", fmt.Errorf("undefined environment variables: %s", strings.Join(undefined, ", "))
+	}
+	if !filepath.IsAbs(key) && !path.IsAbs(key) {
+		if glob {
+			key = escape(context.HomeDir) + "/" + key
+		} else {
+			key = filepath.Join(context.HomeDir, key)
+		}
+	}
+	return key, nil
+}
+
+func countPathComponents(path string) int {
+	count := 0
+	for _, component := range splitPath(path) {
+		if component != "" {
+			count++
+		}
+	}
+	return count
+}
+
+// splitPath は / 区切りの要素に分ける。絶対パスの先頭は空文字列になる
+func splitPath(p string) []string {
+	p = path.Clean(filepath.ToSlash(p))
+	if p == "/" {
+		return []string{""}
+	}
+	return strings.Split(p, "/")
+}
+
+func isGlobPattern(pattern string) bool {
+	return strings.ContainsAny(filepath.ToSlash(pattern), `*?[{\`)
+}
+
+func escapeGlob(s string) string {
+	var builder strings.Builder
+	for _, r := range filepath.ToSlash(s) {
+		if strings.ContainsRune(`*?[]{}\`, r) {
+			builder.WriteRune('\\')
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
+
+// validatePathPattern はグロブとして不正なパスにエラーを返す
+func validatePathPattern(pattern string) error {
+	if !isGlobPattern(pattern) {
+		return nil
+	}
+	return validateGlobPattern(filepath.ToSlash(pattern))
+}
+
+func validateGlobPattern(pattern string) error {
+	alternatives, err := expandBraces(pattern)
+	if err != nil {
+		return err
+	}
+	for _, alternative := range alternatives {
+		for _, component := range strings.Split(alternative, "/") {
+			if _, err := path.Match(component, ""); err != nil {
+				return fmt.Errorf("invalid component '%s', because %w", component, err)
+			}
+		}
+	}
+	return nil
+}
+
+// matchGlobComponents はパターンがディレクトリー自身かその祖先のいずれかに合致するかを判定する
+// ** は 0 個以上の要素に合致する
+func matchGlobComponents(pattern []string, directory []string) bool {
+	if len(pattern) == 0 {
+		// 残りの要素はサブディレクトリー
+		return true
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(directory); i++ {
+			if matchGlobComponents(pattern[1:], directory[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(directory) == 0 {
+		return false
+	}
+	matched, err := path.Match(pattern[0], directory[0])
+	if err != nil || !matched {
+		return false
+	}
+	return matchGlobComponents(pattern[1:], directory[1:])
+}
+
+// expandBraces は {a,b} を展開したパターンの一覧を返す。入れ子にも対応する
+func expandBraces(pattern string) ([]string, error) {
+	start := -1
+	depth := 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '{':
+			if depth == 0 {
+				start = i
+			}
+			depth++
+		case '}':
+			if depth == 0 {
+				return nil, fmt.Errorf("unmatched '}' in pattern: %s", pattern)
+			}
+			depth--
+			if depth == 0 {
+				results := make([]string, 0)
+				for _, alternative := range splitBraceAlternatives(pattern[start+1 : i]) {
+					expanded, err := expandBraces(pattern[:start] + alternative + pattern[i+1:])
+					if err != nil {
+						return nil, err
+					}
+					results = append(results, expanded...)
+				}
+				return results, nil
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unmatched '{' in pattern: %s", pattern)
+	}
+	return []string{pattern}, nil
+}
+
+// splitBraceAlternatives は入れ子の外側にある , で分割する
+func splitBraceAlternatives(s string) []string {
+	alternatives := make([]string, 0)
+	depth := 0
+	last := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				alternatives = append(alternatives, s[last:i])
+				last = i + 1
+			}
+		}
+	}
+	return append(alternatives, s[last:])
+}
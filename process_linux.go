@@ -0,0 +1,40 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readProcessStartTime はプロセスの開始時刻を返す。プロセスがなければ errProcessNotFound を返す
+func readProcessStartTime(pid uint) (string, error) {
+	bytes, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", errProcessNotFound
+		}
+		return "", err
+	}
+	// コマンド名に空白や括弧が含まれうるので最後の ')' より後を見る
+	stat := string(bytes)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	// 3 番目の状態から数えて 22 番目が起動後の開始時刻
+	if len(fields) < 20 {
+		return "", fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+	if fields[0] == "Z" || fields[0] == "X" {
+		return "", errProcessNotFound
+	}
+	return fields[19], nil
+}
+
+// readPidNamespace は PID 名前空間を返す。PID はこの中でだけ意味を持つ
+func readPidNamespace() string {
+	namespace, err := os.Readlink("/proc/self/ns/pid")
+	if err != nil {
+		return ""
+	}
+	return namespace
+}
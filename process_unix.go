@@ -0,0 +1,33 @@
+//go:build unix && !linux
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// readProcessStartTime はプロセスの開始時刻を返す。プロセスがなければ errProcessNotFound を返す
+func readProcessStartTime(pid uint) (string, error) {
+	err := syscall.Kill(int(pid), 0)
+	if errors.Is(err, syscall.ESRCH) {
+		return "", errProcessNotFound
+	}
+	if err != nil && !errors.Is(err, syscall.EPERM) {
+		return "", err
+	}
+	output, err := exec.Command("ps", "-o", "lstart=", "-p", strconv.FormatUint(uint64(pid), 10)).Output()
+	if err != nil {
+		// ps がなくても生きていることはわかる
+		return "", nil
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// readPidNamespace は PID 名前空間を返す。PID 名前空間がなければ空文字列
+func readPidNamespace() string {
+	return ""
+}
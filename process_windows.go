@@ -0,0 +1,43 @@
+//go:build windows
+
+package main
+
+import (
+	"strconv"
+	"syscall"
+)
+
+const (
+	processQueryLimitedInformation = 0x1000
+	stillActive                    = 259
+	errorInvalidParameter          = syscall.Errno(87)
+)
+
+// readProcessStartTime はプロセスの開始時刻を返す。プロセスがなければ errProcessNotFound を返す
+func readProcessStartTime(pid uint) (string, error) {
+	handle, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		if err == errorInvalidParameter {
+			return "", errProcessNotFound
+		}
+		return "", err
+	}
+	defer syscall.CloseHandle(handle)
+	var exitCode uint32
+	if err := syscall.GetExitCodeProcess(handle, &exitCode); err != nil {
+		return "", err
+	}
+	if exitCode != stillActive {
+		return "", errProcessNotFound
+	}
+	var creationTime, exitTime, kernelTime, userTime syscall.Filetime
+	if err := syscall.GetProcessTimes(handle, &creationTime, &exitTime, &kernelTime, &userTime); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(creationTime.Nanoseconds(), 10), nil
+}
+
+// readPidNamespace は PID 名前空間を返す。PID 名前空間がなければ空文字列
+func readPidNamespace() string {
+	return ""
+}
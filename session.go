@@ -0,0 +1,495 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// SessionId はシェルごとのファイルを見分ける ID
+// フックが作るトークンか、以前の版との互換のためのシェルの PID
+type SessionId = string
+
+const sessionEnvName = "ENVAR_SESSION"
+
+// sessionTokenLength はトークンの 16 進数での長さ
+const sessionTokenLength = 32
+
+func isValidSessionId(session string) bool {
+	if _, err := strconv.ParseUint(session, 10, 32); err == nil {
+		return true
+	}
+	if len(session) != sessionTokenLength {
+		return false
+	}
+	for _, c := range session {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSessionPid は PID で見分けるセッションなら PID を返す
+func parseSessionPid(session SessionId) (uint, bool) {
+	shellPid, err := strconv.ParseUint(session, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint(shellPid), true
+}
+
+// newSession はトークンを作り、シェルを記録する
+// PID 名前空間が違えば PID が重なりうるのでトークンで見分ける
+func newSession(shellPid uint) SessionId {
+	bytes := make([]byte, sessionTokenLength/2)
+	if _, err := rand.Read(bytes); err != nil {
+		log.Fatal(fmt.Errorf("failed to generate a session token, because %w", err))
+	}
+	session := hex.EncodeToString(bytes)
+	record, err := makeShellRecord(shellPid)
+	if err != nil {
+		log.Fatal(err)
+	}
+	writeShellRecord(session, record)
+	return session
+}
+
+// シェルごとのファイルには値や元の値が含まれるため本人しか読めないようにする
+const (
+	sessionDirMode  os.FileMode = 0700
+	sessionFileMode os.FileMode = 0600
+)
+
+// makeSessionDir はシェルごとのファイルを置くディレクトリーを返す
+// 再起動で消える $XDG_RUNTIME_DIR を優先し、なければユーザーのキャッシュディレクトリーを使う
+func makeSessionDir() string {
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return filepath.Join(runtimeDir, appName)
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to get user cache dir, because %w", err))
+	}
+	return filepath.Join(cacheDir, appName)
+}
+
+func makeCachePath(session SessionId) string {
+	return filepath.Join(makeSessionDir(), fmt.Sprintf("cache.%s", session))
+}
+
+func makeProfilePath(session SessionId) string {
+	return filepath.Join(makeSessionDir(), fmt.Sprintf("profile.%s", session))
+}
+
+func makeSnapshotPath(session SessionId) string {
+	return filepath.Join(makeSessionDir(), fmt.Sprintf("snapshot.%s.json", session))
+}
+
+// makeShellRecordPath はシェルの PID と開始時刻を記録するファイルのパス
+func makeShellRecordPath(session SessionId) string {
+	return filepath.Join(makeSessionDir(), fmt.Sprintf("shell.%s.json", session))
+}
+
+func makeSessionLockPath(session SessionId) string {
+	return filepath.Join(makeSessionDir(), fmt.Sprintf("lock.%s", session))
+}
+
+func makeCacheKeyPath() string {
+	return filepath.Join(makeSessionDir(), "key")
+}
+
+// makeLegacyCachedScriptPath は値を平文で持っていた以前のキャッシュのパス
+func makeLegacyCachedScriptPath(session SessionId) string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to get user cache dir, because %w", err))
+	}
+	return filepath.Join(cacheDir, appName, fmt.Sprintf("script.%s.bash", session))
+}
+
+func removeSessionFiles(session SessionId) {
+	paths := []string{
+		makeCachePath(session),
+		makeProfilePath(session),
+		makeSnapshotPath(session),
+		makeLegacyCachedScriptPath(session),
+		makeShellRecordPath(session),
+		makeSessionLockPath(session),
+	}
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatal(fmt.Errorf("failed to remove cache file: %s, because %w", path, err))
+		}
+	}
+}
+
+// readSessionFile はファイルがなければ nil を返す
+func readSessionFile(path string) ([]byte, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return bytes, nil
+}
+
+// writeSessionFile は本人しか読めないディレクトリーとファイルに書く
+// 途中まで書かれたファイルを読まれないように、一時ファイルに書いてから置き換える
+func writeSessionFile(path string, bytes []byte) error {
+	dir := filepath.Dir(path)
+	if err := makeSessionDirIfNecessary(dir); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create a temporary file in: %s, because %w", dir, err)
+	}
+	tempPath := file.Name()
+	defer os.Remove(tempPath)
+	if err := file.Chmod(sessionFileMode); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to change the mode of the file: %s, because %w", tempPath, err)
+	}
+	if _, err := file.Write(bytes); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write to the file: %s, because %w", tempPath, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close the file: %s, because %w", tempPath, err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("failed to rename the file: %s to %s, because %w", tempPath, path, err)
+	}
+	return nil
+}
+
+func makeSessionDirIfNecessary(dir string) error {
+	if err := os.MkdirAll(dir, sessionDirMode); err != nil {
+		return fmt.Errorf("failed to create the directory: %s, because %w", dir, err)
+	}
+	// 以前の版で作られたディレクトリーも本人しか読めないようにする
+	if err := os.Chmod(dir, sessionDirMode); err != nil {
+		return fmt.Errorf("failed to change the mode of the directory: %s, because %w", dir, err)
+	}
+	return nil
+}
+
+// lockSessionFile はセッションディレクトリーのロックファイルで排他する。戻り値の関数でロックを外す
+func lockSessionFile(name string) (func(), error) {
+	dir := makeSessionDir()
+	if err := makeSessionDirIfNecessary(dir); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, name)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, sessionFileMode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the lock file: %s, because %w", path, err)
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock the file: %s, because %w", path, err)
+	}
+	return func() {
+		unlockFile(file)
+		file.Close()
+	}, nil
+}
+
+// lockSession はシェルのキャッシュなどの読み込みから書き込みまでを排他する
+func lockSession(session SessionId) func() {
+	unlock, err := lockSessionFile(filepath.Base(makeSessionLockPath(session)))
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to lock the session: %s, because %w", session, err))
+	}
+	return unlock
+}
+
+// Cache は前回の結果。State が変わっていなければ評価し直さない
+type Cache struct {
+	State        string   `json:"state"`
+	Fingerprints []string `json:"fingerprints"`
+}
+
+// readCache は前回の結果を返す。なければ空の結果を返す
+func readCache(session SessionId) *Cache {
+	cachePath := makeCachePath(session)
+	cacheBytes, err := readSessionFile(cachePath)
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to read a cache file: %s, because %w", cachePath, err))
+	}
+	var cache Cache
+	if cacheBytes == nil {
+		return &cache
+	}
+	if err := json.Unmarshal(cacheBytes, &cache); err != nil {
+		log.Fatal(fmt.Errorf("failed to unmarshal a cache file: %s, because %w", cachePath, err))
+	}
+	return &cache
+}
+
+func writeCache(session SessionId, cache *Cache) {
+	cachePath := makeCachePath(session)
+	bytes, err := json.Marshal(cache)
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to marshal a cache, because %w", err))
+	}
+	if err := writeSessionFile(cachePath, bytes); err != nil {
+		log.Fatal(fmt.Errorf("failed to write a cache file: %s, because %w", cachePath, err))
+	}
+	// 以前の版が値を平文で書いたキャッシュを残さない
+	if _, ok := parseSessionPid(session); ok {
+		legacyPath := makeLegacyCachedScriptPath(session)
+		if err := os.Remove(legacyPath); err != nil && !os.IsNotExist(err) {
+			log.Fatal(fmt.Errorf("failed to remove a cache file: %s, because %w", legacyPath, err))
+		}
+	}
+}
+
+// reloadSession は記録した状態を消して、次の実行で評価し直させる
+func reloadSession(session SessionId) {
+	unlock := lockSession(session)
+	defer unlock()
+	cache := readCache(session)
+	cache.State = ""
+	writeCache(session, cache)
+}
+
+// makeState は結果を左右する作業ディレクトリー、プロファイル、設定ファイル、条件で参照する環境変数、
+// Git のリモート、見つかったマーカーの鍵付きハッシュを返す
+func makeState(key []byte, configs *Configs, context MatchContext) (string, error) {
+	mac := hmac.New(sha256.New, key)
+	write := func(s string) {
+		mac.Write([]byte(s))
+		mac.Write([]byte{0})
+	}
+	write(context.WorkingDirectory)
+	write(context.RealWorkingDirectory)
+	write(context.Profile)
+	mac.Write(configs.Digest[:])
+	envNames := slices.Concat(conditionEnvNames(configs.Vars), pathKeyEnvNames(configs.Vars))
+	slices.Sort(envNames)
+	for _, name := range slices.Compact(envNames) {
+		write(name)
+		if value, ok := context.Environment[name]; ok {
+			write("set")
+			write(value)
+		} else {
+			write("unset")
+		}
+	}
+	if repository := context.GitRepository; repository != nil {
+		write("git")
+		write(repository.Root)
+		write(strconv.Itoa(len(repository.Remotes)))
+		for _, remote := range repository.Remotes {
+			write(remote)
+		}
+	} else {
+		write("no git")
+	}
+	for _, marker := range markerNames(configs.Vars) {
+		write(marker)
+		for _, directory := range context.workingDirectories() {
+			projectRoot, err := findMarker(directory, marker, context.HomeDir)
+			if err != nil {
+				return "", err
+			}
+			write(projectRoot)
+		}
+	}
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+var errCannotDecrypt = errors.New("cannot decrypt")
+
+// 鍵の用途。用途ごとに別の鍵を導出する
+const (
+	snapshotPurpose  = "snapshot"
+	execCachePurpose = "exec cache"
+)
+
+// makeSessionCipher はファイルを暗号化する AEAD を返す。鍵は指紋の鍵から用途ごとに導出する
+func makeSessionCipher(key []byte, purpose string) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// readSealedSessionFile は暗号化されたファイルを読む。ファイルがなければ nil を返し、復号できなければ errCannotDecrypt を返す
+func readSealedSessionFile(key []byte, purpose string, path string) ([]byte, error) {
+	bytes, err := readSessionFile(path)
+	if err != nil || bytes == nil {
+		return nil, err
+	}
+	aead, err := makeSessionCipher(key, purpose)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make a cipher, because %w", err)
+	}
+	if len(bytes) < aead.NonceSize() {
+		return nil, errCannotDecrypt
+	}
+	plaintext, err := aead.Open(nil, bytes[:aead.NonceSize()], bytes[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errCannotDecrypt
+	}
+	return plaintext, nil
+}
+
+// writeSealedSessionFile は暗号化してファイルに書く
+func writeSealedSessionFile(key []byte, purpose string, path string, plaintext []byte) error {
+	aead, err := makeSessionCipher(key, purpose)
+	if err != nil {
+		return fmt.Errorf("failed to make a cipher, because %w", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate a nonce, because %w", err)
+	}
+	return writeSessionFile(path, aead.Seal(nonce, nonce, plaintext, nil))
+}
+
+// readCacheKey は指紋の計算に使う鍵を返す。なければ作る
+func readCacheKey() []byte {
+	keyPath := makeCacheKeyPath()
+	// 同時に作って互いに上書きしないようにする
+	unlock, err := lockSessionFile("key.lock")
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to lock a cache key file: %s, because %w", keyPath, err))
+	}
+	defer unlock()
+	key, err := readSessionFile(keyPath)
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to read a cache key file: %s, because %w", keyPath, err))
+	}
+	if key != nil {
+		return key
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal(fmt.Errorf("failed to generate a cache key, because %w", err))
+	}
+	if err := writeSessionFile(keyPath, key); err != nil {
+		log.Fatal(fmt.Errorf("failed to write a cache key file: %s, because %w", keyPath, err))
+	}
+	return key
+}
+
+// fingerprintAssignment は値そのものを残さずに変更を検出するため、変数名と値の鍵付きハッシュを返す
+func fingerprintAssignment(key []byte, assignment Assignment) string {
+	if assignment.Value == nil {
+		return assignment.Name
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(*assignment.Value))
+	return assignment.Name + "=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// readProfile はシェルで有効なプロファイルを返す。なければ空文字列
+func readProfile(session SessionId) string {
+	profilePath := makeProfilePath(session)
+	bytes, err := readSessionFile(profilePath)
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to read a profile file: %s, because %w", profilePath, err))
+	}
+	return strings.TrimSpace(string(bytes))
+}
+
+// writeProfile はシェルで有効なプロファイルを記録する。空文字列なら記録を消す
+func writeProfile(session SessionId, profile string) {
+	profilePath := makeProfilePath(session)
+	if profile == "" {
+		err := os.Remove(profilePath)
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatal(fmt.Errorf("failed to remove a profile file: %s, because %w", profilePath, err))
+		}
+		return
+	}
+	if err := writeSessionFile(profilePath, []byte(profile)); err != nil {
+		log.Fatal(fmt.Errorf("failed to write a profile file: %s, because %w", profilePath, err))
+	}
+}
+
+// Snapshot は envar が設定を始める前の変数の値。nil は設定されていなかったことを表す
+// envar が値を設定している変数だけを持つ
+type Snapshot = map[VarName]*string
+
+// readSnapshot は暗号化された記録を読む。元の値にはトークンなども含まれうる
+func readSnapshot(session SessionId, key []byte) Snapshot {
+	snapshotPath := makeSnapshotPath(session)
+	bytes, err := readSealedSessionFile(key, snapshotPurpose, snapshotPath)
+	decrypted := !errors.Is(err, errCannotDecrypt)
+	if !decrypted {
+		// 以前の版の平文の記録も読む。次に書くときに暗号化する
+		bytes, err = readSessionFile(snapshotPath)
+	}
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to read a snapshot file: %s, because %w", snapshotPath, err))
+	}
+	snapshot := make(Snapshot)
+	if bytes == nil {
+		return snapshot
+	}
+	if err := json.Unmarshal(bytes, &snapshot); err != nil {
+		if !decrypted {
+			// 鍵が作り直されたなどで復号できない記録は、記録がないものとして扱う
+			return make(Snapshot)
+		}
+		log.Fatal(fmt.Errorf("failed to unmarshal a snapshot file: %s, because %w", snapshotPath, err))
+	}
+	return snapshot
+}
+
+func writeSnapshot(session SessionId, key []byte, snapshot Snapshot) {
+	snapshotPath := makeSnapshotPath(session)
+	bytes, err := json.Marshal(snapshot)
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to marshal a snapshot, because %w", err))
+	}
+	if err := writeSealedSessionFile(key, snapshotPurpose, snapshotPath, bytes); err != nil {
+		log.Fatal(fmt.Errorf("failed to write a snapshot file: %s, because %w", snapshotPath, err))
+	}
+}
+
+// takeSnapshot は変数をまだ設定していなければ現在の値を記録する
+func takeSnapshot(snapshot Snapshot, varName VarName) {
+	if _, ok := snapshot[varName]; ok {
+		return
+	}
+	if value, ok := os.LookupEnv(varName); ok {
+		snapshot[varName] = &value
+	} else {
+		snapshot[varName] = nil
+	}
+}
+
+// restoreRemovedVars は設定から消えた変数を envar が設定する前の値に戻し、記録から消す
+func restoreRemovedVars(snapshot Snapshot, varsConfig *VarsConfig) []Assignment {
+	assignments := make([]Assignment, 0)
+	for varName, original := range snapshot {
+		if _, ok := (*varsConfig)[varName]; !ok {
+			assignments = append(assignments, Assignment{Name: varName, Value: original})
+			delete(snapshot, varName)
+		}
+	}
+	return assignments
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+type ShellName = string
+
+// ShellSyntax は環境変数を設定・解除するスクリプトの書式
+type ShellSyntax struct {
+	Export func(varName VarName, value string) string
+	Unset  func(varName VarName) string
+	// 変更をまとめて出力する必要があるシェルのみ。Export と Unset の代わりに使う。nil なら 1 行ずつ出力する
+	Render func(assignments []Assignment) string
+}
+
+// Line は 1 つの変数の設定または解除を表す 1 行
+func (syntax ShellSyntax) Line(assignment Assignment) string {
+	if assignment.Value == nil {
+		return syntax.Unset(assignment.Name)
+	}
+	return syntax.Export(assignment.Name, *assignment.Value)
+}
+
+func (syntax ShellSyntax) Script(assignments []Assignment) string {
+	if syntax.Render != nil {
+		return syntax.Render(assignments)
+	}
+	var builder strings.Builder
+	for _, assignment := range assignments {
+		builder.WriteString(syntax.Line(assignment))
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+var posixSyntax = ShellSyntax{
+	Export: func(varName VarName, value string) string {
+		return fmt.Sprintf("export %s=%s", varName, quotePosix(value))
+	},
+	Unset: func(varName VarName) string {
+		return fmt.Sprintf("unset %s", varName)
+	},
+}
+
+var fishSyntax = ShellSyntax{
+	Export: func(varName VarName, value string) string {
+		return fmt.Sprintf("set -gx %s %s", varName, quoteFish(value))
+	},
+	Unset: func(varName VarName) string {
+		return fmt.Sprintf("set -e %s", varName)
+	},
+}
+
+var nuSyntax = ShellSyntax{
+	Render: func(assignments []Assignment) string {
+		// Nushell には eval がないため load-env と hide-env に渡すレコードを出力する
+		record := struct {
+			Set  map[VarName]string `json:"set"`
+			Hide []VarName          `json:"hide"`
+		}{
+			Set:  make(map[VarName]string),
+			Hide: make([]VarName, 0),
+		}
+		for _, assignment := range assignments {
+			if assignment.Value == nil {
+				record.Hide = append(record.Hide, assignment.Name)
+			} else {
+				record.Set[assignment.Name] = *assignment.Value
+			}
+		}
+		bytes, err := json.Marshal(record)
+		if err != nil {
+			log.Fatal(fmt.Errorf("failed to marshal nu record, because %w", err))
+		}
+		return string(bytes) + "\n"
+	},
+}
+
+var pwshSyntax = ShellSyntax{
+	Export: func(varName VarName, value string) string {
+		return fmt.Sprintf("$env:%s = %s", varName, quotePwsh(value))
+	},
+	Unset: func(varName VarName) string {
+		return fmt.Sprintf("Remove-Item Env:%s -ErrorAction SilentlyContinue", varName)
+	},
+}
+
+var shellSyntaxes = map[ShellName]ShellSyntax{
+	"bash": posixSyntax,
+	"zsh":  posixSyntax,
+	"fish": fishSyntax,
+	"nu":   nuSyntax,
+	"pwsh": pwshSyntax,
+}
+
+// シングルクォート内ではエスケープができないため ' は一旦閉じて \' として埋め込む
+func quotePosix(value string) string {
+	return "'" + strings.ReplaceAll(value, `'`, `'\''`) + "'"
+}
+
+// fish のシングルクォート内では \\ と \' のみがエスケープされる
+func quoteFish(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// PowerShell は ' に加えて ‘ ’ ‚ ‛ もシングルクォートとして扱い、どれも 2 つ重ねてエスケープする
+func quotePwsh(value string) string {
+	var builder strings.Builder
+	builder.WriteRune('\'')
+	for _, r := range value {
+		switch r {
+		case '\'', '\u2018', '\u2019', '\u201a', '\u201b':
+			builder.WriteRune(r)
+		}
+		builder.WriteRune(r)
+	}
+	builder.WriteRune('\'')
+	return builder.String()
+}
+
+//go:embed hook.bash
+var bashHookScript string
+
+//go:embed hook.zsh
+var zshHookScript string
+
+//go:embed hook.fish
+var fishHookScript string
+
+//go:embed hook.nu
+var nuHookScript string
+
+//go:embed hook.ps1
+var pwshHookScript string
+
+var hookScripts = map[ShellName]string{
+	"bash": bashHookScript,
+	"zsh":  zshHookScript,
+	"fish": fishHookScript,
+	"nu":   nuHookScript,
+	"pwsh": pwshHookScript,
+}